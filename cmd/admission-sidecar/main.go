@@ -7,21 +7,57 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
 	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/mutating"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/pipeline"
 	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/validating"
+	"github.com/chainguard-dev/admission-sidecar/pkg/server"
 	"github.com/kelseyhightower/envconfig"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	"knative.dev/pkg/injection"
 	"knative.dev/pkg/injection/sharedmain"
 	"knative.dev/pkg/logging"
 	"knative.dev/pkg/signals"
+	"knative.dev/pkg/system"
 	"knative.dev/pkg/webhook"
 )
 
 type EnvConfig struct {
 	Port         int  `envconfig:"PROXY_PORT" default:"8088"`
 	RequireLabel bool `envconfig:"REQUIRE_LABEL" default:"false"`
+
+	NamespaceSelector        string `envconfig:"NAMESPACE_SELECTOR"`
+	NamespaceExcludeSelector string `envconfig:"NAMESPACE_EXCLUDE_SELECTOR"`
+	// ExemptNamespaces are never proxied, in addition to SYSTEM_NAMESPACE.
+	// Defaults to filter.DefaultExemptNamespaces.
+	ExemptNamespaces []string `envconfig:"EXEMPT_NAMESPACES"`
+
+	NamespaceFailurePolicy    string        `envconfig:"NAMESPACE_FAILURE_POLICY" default:"Fail"`
+	NamespaceNegativeCacheTTL time.Duration `envconfig:"NAMESPACE_NEGATIVE_CACHE_TTL" default:"5s"`
+
+	ClusterScopedPolicy   string `envconfig:"CLUSTER_SCOPED_POLICY" default:"Always"`
+	ClusterScopedSelector string `envconfig:"CLUSTER_SCOPED_SELECTOR"`
+
+	// ExemptUsers is a JSON list of filter.UserRules.
+	ExemptUsers string `envconfig:"EXEMPT_USERS"`
+
+	// Filters is the order of the filters, see filter.NewChain. Defaults to
+	// filter.DefaultFilters.
+	Filters []string `envconfig:"FILTERS"`
+	// CELFilters is a JSON list of filter.CELFilterConfigs.
+	CELFilters string `envconfig:"CEL_FILTERS"`
+
+	RetryAttempts    int           `envconfig:"RETRY_ATTEMPTS" default:"3"`
+	RetryBackoff     time.Duration `envconfig:"RETRY_BACKOFF" default:"100ms"`
+	BreakerThreshold int           `envconfig:"BREAKER_THRESHOLD" default:"5"`
+	BreakerCooldown  time.Duration `envconfig:"BREAKER_COOLDOWN" default:"30s"`
+
+	MaxRequestBytes  int64 `envconfig:"MAX_REQUEST_BYTES" default:"8388608"`
+	MaxResponseBytes int64 `envconfig:"MAX_RESPONSE_BYTES" default:"8388608"`
 }
 
 func main() {
@@ -40,11 +76,98 @@ func main() {
 
 	ctx = filter.WithRequireLabel(ctx, ec.RequireLabel)
 	logging.FromContext(ctx).Infof("Enforcing only on labeled namespaces: %v", ec.RequireLabel)
+	include, err := filter.ParseSelector(ec.NamespaceSelector)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse NAMESPACE_SELECTOR: %v", err))
+	}
+	exclude, err := filter.ParseSelector(ec.NamespaceExcludeSelector)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse NAMESPACE_EXCLUDE_SELECTOR: %v", err))
+	}
+	ctx = filter.WithNamespaceSelectors(ctx, filter.NamespaceSelectors{Include: include, Exclude: exclude})
+	logging.FromContext(ctx).Infof("Enforcing on namespaces selected by %q, except %q", ec.NamespaceSelector, ec.NamespaceExcludeSelector)
+	exempt := ec.ExemptNamespaces
+	if len(exempt) == 0 {
+		exempt = append([]string{}, filter.DefaultExemptNamespaces...)
+	}
+	if ns := os.Getenv(system.NamespaceEnvKey); ns != "" {
+		// Never let a delegate get in the way of our own pods.
+		exempt = append(exempt, ns)
+	}
+	ctx = filter.WithExemptNamespaces(ctx, exempt)
+	logging.FromContext(ctx).Infof("Exempting namespaces: %v", exempt)
+
+	policy := admissionregistrationv1.FailurePolicyType(ec.NamespaceFailurePolicy)
+	if policy != admissionregistrationv1.Fail && policy != admissionregistrationv1.Ignore {
+		panic(fmt.Sprintf("NAMESPACE_FAILURE_POLICY must be %s or %s, got %q", admissionregistrationv1.Fail, admissionregistrationv1.Ignore, policy))
+	}
+	ctx = filter.WithNamespaceLookupOptions(ctx, filter.NamespaceLookupOptions{
+		FailurePolicy:    policy,
+		NegativeCacheTTL: ec.NamespaceNegativeCacheTTL,
+	})
+	logging.FromContext(ctx).Infof("Namespace lookup failure policy: %s", policy)
+
+	clusterSelector, err := filter.ParseSelector(ec.ClusterScopedSelector)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse CLUSTER_SCOPED_SELECTOR: %v", err))
+	}
+	cluster := filter.ClusterScopedOptions{
+		Policy:   filter.ClusterScopedPolicy(ec.ClusterScopedPolicy),
+		Selector: clusterSelector,
+	}
+	if err := cluster.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid CLUSTER_SCOPED_POLICY: %v", err))
+	}
+	ctx = filter.WithClusterScopedOptions(ctx, cluster)
+	logging.FromContext(ctx).Infof("Cluster scoped resources policy: %s %s", cluster.Policy, ec.ClusterScopedSelector)
+
+	users, err := filter.ParseUserRules(ec.ExemptUsers)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse EXEMPT_USERS: %v", err))
+	}
+	ctx = filter.WithUserRules(ctx, users)
+	logging.FromContext(ctx).Infof("Exempting users matching %d rules", len(users))
+
+	celFilters, err := filter.ParseCELFilters(ec.CELFilters)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse CEL_FILTERS: %v", err))
+	}
+	filters := ec.Filters
+	if len(filters) == 0 {
+		filters = filter.DefaultFilters
+	}
+	chain, err := filter.NewChain(ctx, filters, celFilters)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create filters: %v", err))
+	}
+	ctx = filter.WithChain(ctx, chain)
+	logging.FromContext(ctx).Infof("Filtering requests with %v", filters)
+
+	ctx = proxy.WithRetryOptions(ctx, proxy.RetryOptions{
+		Attempts:         ec.RetryAttempts,
+		Backoff:          ec.RetryBackoff,
+		BreakerThreshold: ec.BreakerThreshold,
+		BreakerCooldown:  ec.BreakerCooldown,
+	})
+	logging.FromContext(ctx).Infof("Retrying delegates %d times, opening breaker after %d failures", ec.RetryAttempts, ec.BreakerThreshold)
+	ctx = proxy.WithBodyLimits(ctx, proxy.BodyLimits{
+		MaxRequestBytes:  ec.MaxRequestBytes,
+		MaxResponseBytes: ec.MaxResponseBytes,
+	})
 	logging.FromContext(ctx).Infof("Starting to listen on %d", ec.Port)
+	// The admission controllers are served by srv instead of sharedmain, so
+	// that request bodies are limited before they are decoded.
+	srv := &server.Server{}
+	// /mutate, /admit, /admit-all and /pipeline share their delegates.
+	mutatingControllers := &mutating.Controllers{}
+	validatingControllers := &validating.Controllers{}
 	sharedmain.MainWithConfig(ctx, "admission-sidecar", cfg,
 		// NewValidationAdmissionController,
-		mutating.NewController,
+		srv.Register(mutatingControllers.NewController),
 		// Controller
-		validating.NewController,
+		srv.Register(validatingControllers.NewController),
+		srv.Register(validatingControllers.NewFanOutController),
+		srv.Register(pipeline.NewController(mutatingControllers, validatingControllers)),
+		srv.NewController,
 	)
 }
@@ -0,0 +1,127 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package admission looks at AdmissionRequests the same way for the filters
+// and the delegates: the labels of their objects, and CEL expressions about
+// them.
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// CostLimit bounds how expensive evaluating a single expression can get.
+const CostLimit = 1000000
+
+// Variables available to all the expressions, like in the MatchConditions of
+// the kube-apiserver: request is the AdmissionRequest, object and oldObject
+// are its objects, all as they are in JSON.
+const (
+	RequestVar   = "request"
+	ObjectVar    = "object"
+	OldObjectVar = "oldObject"
+)
+
+// NewEnv creates the CEL environment for expressions about requests, with
+// the variables above and the given extra ones.
+func NewEnv(extra ...string) (*cel.Env, error) {
+	opts := make([]cel.EnvOption, 0, 3+len(extra))
+	for _, name := range append([]string{RequestVar, ObjectVar, OldObjectVar}, extra...) {
+		opts = append(opts, cel.Variable(name, cel.DynType))
+	}
+	return cel.NewEnv(opts...)
+}
+
+// Compile compiles an expression that must evaluate to a bool.
+func Compile(env *cel.Env, expression string) (cel.Program, error) {
+	ast, iss := env.Compile(expression)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	// Either a bool, or dyn which is only known to be a bool when run.
+	if !ast.OutputType().IsAssignableType(cel.BoolType) {
+		return nil, fmt.Errorf("must evaluate to bool, got %s", ast.OutputType())
+	}
+	return env.Program(ast, cel.CostLimit(CostLimit))
+}
+
+// Eval evaluates a program created by Compile.
+func Eval(program cel.Program, vars map[string]interface{}) (bool, error) {
+	val, _, err := program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	ret, ok := val.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluated to %v, not a bool", val.Value())
+	}
+	return ret, nil
+}
+
+// Vars creates the variables of NewEnv for the request. The extra ones are
+// up to the caller.
+func Vars(request *admissionv1.AdmissionRequest) (map[string]interface{}, error) {
+	req, err := ToJSONValue(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert request: %w", err)
+	}
+	object, err := rawToJSONValue(request.Object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+	oldObject, err := rawToJSONValue(request.OldObject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode oldObject: %w", err)
+	}
+	return map[string]interface{}{
+		RequestVar:   req,
+		ObjectVar:    object,
+		OldObjectVar: oldObject,
+	}, nil
+}
+
+// ToJSONValue returns v as it is in JSON, for use as a variable.
+func ToJSONValue(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var ret map[string]interface{}
+	err = json.Unmarshal(b, &ret)
+	return ret, err
+}
+
+// rawToJSONValue decodes the object in the RawExtension, returning nil if
+// there is none.
+func rawToJSONValue(raw runtime.RawExtension) (interface{}, error) {
+	if len(raw.Raw) == 0 {
+		return nil, nil
+	}
+	var ret map[string]interface{}
+	err := json.Unmarshal(raw.Raw, &ret)
+	return ret, err
+}
+
+// ObjectLabels returns the labels of the object in the RawExtension, or nil
+// if there is no object. Objects without labels have empty ones.
+func ObjectLabels(raw runtime.RawExtension) (map[string]string, error) {
+	if len(raw.Raw) == 0 {
+		return nil, nil
+	}
+	obj := &metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(raw.Raw, obj); err != nil {
+		return nil, fmt.Errorf("failed to get labels of object: %w", err)
+	}
+	if obj.Labels == nil {
+		return map[string]string{}, nil
+	}
+	return obj.Labels, nil
+}
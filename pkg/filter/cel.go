@@ -0,0 +1,116 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/admission"
+	"github.com/google/cel-go/cel"
+	v1 "k8s.io/api/core/v1"
+)
+
+// namespaceObjectVar is the Namespace of the request as it is in JSON, or
+// null for cluster scoped requests. Same as in the kube-apiserver,
+// "namespace" can't be used since it is reserved in CEL.
+const namespaceObjectVar = "namespaceObject"
+
+// celEnv is the CEL environment of the filters, with the variables of
+// admission.NewEnv and namespaceObject.
+var celEnv, celEnvErr = admission.NewEnv(namespaceObjectVar)
+
+// CELFilterConfig configures a CELFilter.
+type CELFilterConfig struct {
+	// Name of the filter.
+	Name string `json:"name"`
+	// Expression that decides whether the filter applies to a request.
+	Expression string `json:"expression"`
+	// Decision when the Expression is true, Skip or Proxy. Otherwise the
+	// filter leaves the decision to the next ones.
+	Decision string `json:"decision"`
+}
+
+// CELFilter makes its decision for requests its expression is true for.
+type CELFilter struct {
+	name     string
+	decision Decision
+	program  cel.Program
+}
+
+var _ Filter = (*CELFilter)(nil)
+
+// ParseCELFilters parses a JSON list of CELFilterConfigs and compiles them.
+func ParseCELFilters(s string) ([]*CELFilter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var configs []CELFilterConfig
+	if err := json.Unmarshal([]byte(s), &configs); err != nil {
+		return nil, err
+	}
+	ret := make([]*CELFilter, 0, len(configs))
+	for _, c := range configs {
+		f, err := NewCELFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// NewCELFilter compiles the expression of the filter.
+func NewCELFilter(c CELFilterConfig) (*CELFilter, error) {
+	if celEnvErr != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", celEnvErr)
+	}
+	if c.Name == "" {
+		return nil, fmt.Errorf("CEL filter %q: missing name", c.Expression)
+	}
+	f := &CELFilter{name: c.Name, decision: parseDecision(c.Decision)}
+	if f.decision == Continue {
+		return nil, fmt.Errorf("CEL filter %q: decision must be %s or %s, got %q", c.Name, Skip, Proxy, c.Decision)
+	}
+	program, err := admission.Compile(celEnv, c.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("CEL filter %q: %w", c.Name, err)
+	}
+	f.program = program
+	return f, nil
+}
+
+func (f *CELFilter) Name() string {
+	return CELFilters + ":" + f.name
+}
+
+func (f *CELFilter) Decide(_ context.Context, request *Request, ns *v1.Namespace) (Decision, error) {
+	vars, err := request.celVars(ns)
+	if err != nil {
+		return Continue, err
+	}
+	matched, err := admission.Eval(f.program, vars)
+	if err != nil {
+		return Continue, err
+	}
+	if matched {
+		return f.decision, nil
+	}
+	return Continue, nil
+}
+
+// parseDecision returns the Skip or Proxy Decision with the given name, or
+// Continue.
+func parseDecision(s string) Decision {
+	for _, d := range []Decision{Skip, Proxy} {
+		if strings.EqualFold(s, d.String()) {
+			return d
+		}
+	}
+	return Continue
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/admission"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Decision of a Filter about a request.
+type Decision int
+
+const (
+	// Continue leaves the decision to the next filters in the Chain.
+	Continue Decision = iota
+	// Skip lets the request through without proxying it.
+	Skip
+	// Proxy proxies the request, whatever the next filters would say.
+	Proxy
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Skip:
+		return "Skip"
+	case Proxy:
+		return "Proxy"
+	}
+	return "Continue"
+}
+
+// Names of the built in filters, see NewChain.
+const (
+	ExemptNamespacesFilter = "exemptNamespaces"
+	UsersFilter            = "users"
+	CELFilters             = "cel"
+	ClusterScopedFilter    = "clusterScoped"
+	NamespaceFilter        = "namespace"
+)
+
+// DefaultFilters is the order the filters are run in by default.
+var DefaultFilters = []string{ExemptNamespacesFilter, UsersFilter, CELFilters, ClusterScopedFilter, NamespaceFilter}
+
+// Filter decides whether a request should be proxied.
+type Filter interface {
+	// Name of the filter, for reporting which one made the decision.
+	Name() string
+	// Decide whether to proxy the request. ns is the namespace of the
+	// request, or nil for cluster scoped requests.
+	Decide(ctx context.Context, request *Request, ns *v1.Namespace) (Decision, error)
+}
+
+// Request is the request Filters decide about. It also keeps what the
+// filters make out of the request, like the variables of the CEL filters, so
+// that it is only made once however many filters need it.
+type Request struct {
+	*admissionv1.AdmissionRequest
+
+	vars   map[string]interface{}
+	varsNS *v1.Namespace
+}
+
+// NewRequest returns the Request for Filters to decide about the given one.
+func NewRequest(request *admissionv1.AdmissionRequest) *Request {
+	return &Request{AdmissionRequest: request}
+}
+
+// celVars returns the variables of the CEL filters for the request in ns,
+// creating them the first time.
+func (r *Request) celVars(ns *v1.Namespace) (map[string]interface{}, error) {
+	if r.vars != nil && r.varsNS == ns {
+		return r.vars, nil
+	}
+	vars, err := admission.Vars(r.AdmissionRequest)
+	if err != nil {
+		return nil, err
+	}
+	var namespace interface{}
+	if ns != nil {
+		if namespace, err = admission.ToJSONValue(ns); err != nil {
+			return nil, fmt.Errorf("failed to convert namespace: %w", err)
+		}
+	}
+	vars[namespaceObjectVar] = namespace
+	r.vars, r.varsNS = vars, ns
+	return vars, nil
+}
+
+// namespaceFree is implemented by the Filters that decide without the
+// namespace of the request, so that the Chain does not get it for them.
+type namespaceFree interface {
+	namespaceFree()
+}
+
+// NamespaceGetter gets the namespace of a request, or nil for cluster scoped
+// requests.
+type NamespaceGetter func() (*v1.Namespace, error)
+
+// Chain runs Filters in order.
+type Chain []Filter
+
+// Decide returns the decision of the first filter that does not Continue, and
+// its name. If none of them decide, the request is proxied. The namespace is
+// only gotten once a filter needs it, so that requests skipped by the filters
+// before that, like exempt namespaces and users, never depend on getting it.
+// Errors getting it are returned as is.
+func (c Chain) Decide(ctx context.Context, request *admissionv1.AdmissionRequest, namespace NamespaceGetter) (Decision, string, error) {
+	var (
+		ns  *v1.Namespace
+		got bool
+	)
+	r := NewRequest(request)
+	for _, f := range c {
+		if _, ok := f.(namespaceFree); !ok && !got {
+			var err error
+			if ns, err = namespace(); err != nil {
+				return Continue, f.Name(), err
+			}
+			got = true
+		}
+		decision, err := f.Decide(ctx, r, ns)
+		if err != nil {
+			return Continue, f.Name(), fmt.Errorf("filter %s: %w", f.Name(), err)
+		}
+		if decision != Continue {
+			return decision, f.Name(), nil
+		}
+	}
+	return Proxy, "", nil
+}
+
+// NewChain builds the chain with the named filters, in order, configured from
+// the options in the context. CELFilters stands for all the given CEL filters.
+func NewChain(ctx context.Context, names []string, cel []*CELFilter) (Chain, error) {
+	var chain Chain
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case ExemptNamespacesFilter:
+			chain = append(chain, &exemptNamespacesFilter{namespaces: GetExemptNamespaces(ctx)})
+		case UsersFilter:
+			chain = append(chain, &usersFilter{rules: GetUserRules(ctx)})
+		case CELFilters:
+			for _, f := range cel {
+				chain = append(chain, f)
+			}
+		case ClusterScopedFilter:
+			chain = append(chain, &clusterScopedFilter{namespaceFilter: newNamespaceFilter(ctx), opts: GetClusterScopedOptions(ctx)})
+		case NamespaceFilter:
+			chain = append(chain, newNamespaceFilter(ctx))
+		default:
+			return nil, fmt.Errorf("unknown filter %q", name)
+		}
+	}
+	return chain, nil
+}
+
+// chainKey is used as the key for associating the Chain with the context.
+type chainKey struct{}
+
+// WithChain sets the Chain of filters requests go through.
+func WithChain(ctx context.Context, chain Chain) context.Context {
+	return context.WithValue(ctx, chainKey{}, chain)
+}
+
+// GetChain retrieves the Chain associated with the given context via
+// WithChain (above). Without one, the DefaultFilters are configured from
+// the options in the context.
+func GetChain(ctx context.Context) Chain {
+	v := ctx.Value(chainKey{})
+	if v == nil {
+		// The built in filters can't fail.
+		chain, _ := NewChain(ctx, DefaultFilters, nil)
+		return chain
+	}
+	return v.(Chain)
+}
+
+// exemptNamespacesFilter skips requests in exempt namespaces, see IsExempt.
+type exemptNamespacesFilter struct {
+	namespaces []string
+}
+
+func (f *exemptNamespacesFilter) Name() string {
+	return ExemptNamespacesFilter
+}
+
+func (f *exemptNamespacesFilter) namespaceFree() {}
+
+func (f *exemptNamespacesFilter) Decide(ctx context.Context, request *Request, _ *v1.Namespace) (Decision, error) {
+	if _, ok := IsExempt(WithExemptNamespaces(ctx, f.namespaces), request.AdmissionRequest); ok {
+		return Skip, nil
+	}
+	return Continue, nil
+}
+
+// usersFilter skips requests by exempt users, see IsUserExempt.
+type usersFilter struct {
+	rules []UserRule
+}
+
+func (f *usersFilter) Name() string {
+	return UsersFilter
+}
+
+func (f *usersFilter) namespaceFree() {}
+
+func (f *usersFilter) Decide(ctx context.Context, request *Request, _ *v1.Namespace) (Decision, error) {
+	if IsUserExempt(WithUserRules(ctx, f.rules), request.AdmissionRequest) {
+		return Skip, nil
+	}
+	return Continue, nil
+}
+
+// namespaceFilter skips requests in namespaces not selected for inclusion,
+// see ShouldProxy, and requests for Namespaces not selected, see
+// ShouldProxyNamespace.
+type namespaceFilter struct {
+	requireLabel bool
+	selectors    NamespaceSelectors
+}
+
+func newNamespaceFilter(ctx context.Context) *namespaceFilter {
+	return &namespaceFilter{requireLabel: GetRequireLabel(ctx), selectors: GetNamespaceSelectors(ctx)}
+}
+
+func (f *namespaceFilter) Name() string {
+	return NamespaceFilter
+}
+
+func (f *namespaceFilter) withOptions(ctx context.Context) context.Context {
+	return WithNamespaceSelectors(WithRequireLabel(ctx, f.requireLabel), f.selectors)
+}
+
+func (f *namespaceFilter) Decide(ctx context.Context, request *Request, ns *v1.Namespace) (Decision, error) {
+	if isNamespaceRequest(request.AdmissionRequest) {
+		// The labels stored for the Namespace may be the ones the request
+		// is changing.
+		proxied, err := ShouldProxyNamespace(f.withOptions(ctx), request.AdmissionRequest)
+		if err != nil || proxied {
+			return Continue, err
+		}
+		return Skip, nil
+	}
+	if ns == nil || ShouldProxy(f.withOptions(ctx), ns) {
+		return Continue, nil
+	}
+	return Skip, nil
+}
+
+// clusterScopedFilter skips requests for cluster scoped resources, Namespaces
+// included, that should not be proxied, see ShouldProxyClusterScoped.
+type clusterScopedFilter struct {
+	*namespaceFilter
+	opts ClusterScopedOptions
+}
+
+func (f *clusterScopedFilter) Name() string {
+	return ClusterScopedFilter
+}
+
+func (f *clusterScopedFilter) namespaceFree() {}
+
+func (f *clusterScopedFilter) Decide(ctx context.Context, request *Request, _ *v1.Namespace) (Decision, error) {
+	if request.Namespace != "" && !isNamespaceRequest(request.AdmissionRequest) {
+		return Continue, nil
+	}
+	proxied, err := ShouldProxyClusterScoped(WithClusterScopedOptions(f.withOptions(ctx), f.opts), request.AdmissionRequest)
+	if err != nil || proxied {
+		return Continue, err
+	}
+	return Skip, nil
+}
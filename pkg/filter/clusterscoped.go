@@ -0,0 +1,126 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/admission"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ClusterScopedPolicy says which requests for cluster scoped resources,
+// other than Namespaces, are proxied.
+type ClusterScopedPolicy string
+
+const (
+	// ClusterScopedAlways proxies all of them.
+	ClusterScopedAlways ClusterScopedPolicy = "Always"
+	// ClusterScopedNever proxies none of them.
+	ClusterScopedNever ClusterScopedPolicy = "Never"
+	// ClusterScopedSelector proxies the ones whose object is selected by the
+	// Selector of the ClusterScopedOptions.
+	ClusterScopedSelector ClusterScopedPolicy = "Selector"
+)
+
+// ClusterScopedOptions decide which requests for cluster scoped resources
+// are proxied.
+type ClusterScopedOptions struct {
+	// Policy for cluster scoped resources. Empty is treated as Always.
+	Policy ClusterScopedPolicy
+	// Selector of the objects to proxy with the Selector policy.
+	Selector labels.Selector
+}
+
+// Validate checks the policy is known and has what it needs.
+func (o ClusterScopedOptions) Validate() error {
+	switch o.Policy {
+	case "", ClusterScopedAlways, ClusterScopedNever:
+		return nil
+	case ClusterScopedSelector:
+		if o.Selector == nil {
+			return fmt.Errorf("the %s policy needs a selector", o.Policy)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown cluster scoped policy %q", o.Policy)
+}
+
+// ShouldProxyClusterScoped checks whether a request for a cluster scoped
+// resource should be proxied. Requests for Namespaces are checked with
+// ShouldProxyNamespace. Requests for other cluster scoped resources follow
+// the policy set with WithClusterScopedOptions.
+func ShouldProxyClusterScoped(ctx context.Context, request *admissionv1.AdmissionRequest) (bool, error) {
+	if isNamespaceRequest(request) {
+		return ShouldProxyNamespace(ctx, request)
+	}
+	objects := []runtime.RawExtension{request.Object, request.OldObject}
+	opts := GetClusterScopedOptions(ctx)
+	switch opts.Policy {
+	case ClusterScopedNever:
+		return false, nil
+	case ClusterScopedSelector:
+		for _, raw := range objects {
+			l, err := admission.ObjectLabels(raw)
+			if err != nil {
+				return false, err
+			}
+			if l != nil && opts.Selector.Matches(labels.Set(l)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// ShouldProxyNamespace checks whether a request for a Namespace should be
+// proxied. It is checked like requests in that Namespace would be, with the
+// labels of the object or the old object rather than the ones stored, so that
+// adding or removing the labels that select it can't get around the proxy.
+func ShouldProxyNamespace(ctx context.Context, request *admissionv1.AdmissionRequest) (bool, error) {
+	for _, raw := range []runtime.RawExtension{request.Object, request.OldObject} {
+		l, err := admission.ObjectLabels(raw)
+		if err != nil {
+			return false, err
+		}
+		if l != nil && ShouldProxy(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: request.Name, Labels: l}}) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isNamespaceRequest checks if the request is for a Namespace. The
+// kube-apiserver sets the namespace of those to the Namespace itself, except
+// when it is created, so the namespace of the request can't tell.
+func isNamespaceRequest(request *admissionv1.AdmissionRequest) bool {
+	return request.Resource.Group == "" && request.Resource.Resource == "namespaces"
+}
+
+// clusterScopedKey is used as the key for associating the
+// ClusterScopedOptions with the context.
+type clusterScopedKey struct{}
+
+// WithClusterScopedOptions sets the ClusterScopedOptions.
+func WithClusterScopedOptions(ctx context.Context, opts ClusterScopedOptions) context.Context {
+	return context.WithValue(ctx, clusterScopedKey{}, opts)
+}
+
+// GetClusterScopedOptions retrieves the ClusterScopedOptions associated with
+// the given context via WithClusterScopedOptions (above).
+func GetClusterScopedOptions(ctx context.Context) ClusterScopedOptions {
+	v := ctx.Value(clusterScopedKey{})
+	if v == nil {
+		return ClusterScopedOptions{}
+	}
+	return v.(ClusterScopedOptions)
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// DefaultExemptNamespaces are the namespaces of the control plane, and the
+// one OPA runs in with the Styra integration, which a misbehaving delegate
+// must not be able to wedge.
+var DefaultExemptNamespaces = []string{"kube-system", "kube-public", "kube-node-lease", "styra-system"}
+
+// IsExempt returns the namespace of the request if it is one of the exempt
+// namespaces, see WithExemptNamespaces. Requests for a Namespace itself are
+// exempt if that Namespace is.
+func IsExempt(ctx context.Context, request *admissionv1.AdmissionRequest) (string, bool) {
+	ns := request.Namespace
+	if request.Resource.Group == "" && request.Resource.Resource == "namespaces" {
+		ns = request.Name
+	}
+	if ns == "" {
+		return "", false
+	}
+	for _, exempt := range GetExemptNamespaces(ctx) {
+		if ns == exempt {
+			return ns, true
+		}
+	}
+	return "", false
+}
+
+// exemptNamespacesKey is used as the key for associating the exempt
+// namespaces with the context.
+type exemptNamespacesKey struct{}
+
+// WithExemptNamespaces sets the namespaces whose requests are never proxied.
+func WithExemptNamespaces(ctx context.Context, namespaces []string) context.Context {
+	return context.WithValue(ctx, exemptNamespacesKey{}, namespaces)
+}
+
+// GetExemptNamespaces retrieves the exempt namespaces associated with the
+// given context via WithExemptNamespaces (above), or the
+// DefaultExemptNamespaces if there are none.
+func GetExemptNamespaces(ctx context.Context) []string {
+	v := ctx.Value(exemptNamespacesKey{})
+	if v == nil {
+		return DefaultExemptNamespaces
+	}
+	return v.([]string)
+}
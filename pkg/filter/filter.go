@@ -9,6 +9,7 @@ import (
 	"context"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 // Label that a namespace must have or proxy will just return pass for it.
@@ -16,8 +17,17 @@ const InclusionLabel = "proxy.chainguard.dev/include"
 const InclusionValue = "true"
 
 // ShouldProxy checks the namespace for labels to see if the namespace is
-// labeled for inclusion.
+// selected for inclusion, see WithNamespaceSelectors. Without an inclusion
+// selector, the namespace must be labeled for inclusion if a label is
+// required.
 func ShouldProxy(ctx context.Context, ns *v1.Namespace) bool {
+	selectors := GetNamespaceSelectors(ctx)
+	if selectors.Exclude != nil && selectors.Exclude.Matches(labels.Set(ns.Labels)) {
+		return false
+	}
+	if selectors.Include != nil {
+		return selectors.Include.Matches(labels.Set(ns.Labels))
+	}
 	if !GetRequireLabel(ctx) {
 		return true
 	}
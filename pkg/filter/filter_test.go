@@ -7,10 +7,20 @@ package filter
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	nslisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"knative.dev/pkg/ptr"
 )
 
@@ -105,3 +115,513 @@ func TestRequireLabel(t *testing.T) {
 		}
 	}
 }
+
+func TestShouldProxyNamespaceSelectors(t *testing.T) {
+	tests := []struct {
+		name         string
+		include      string
+		exclude      string
+		requireLabel bool
+		labels       map[string]string
+		want         bool
+	}{{
+		name:   "no selectors",
+		labels: map[string]string{"team": "a"},
+		want:   true,
+	}, {
+		name:    "included",
+		include: "team in (a,b),env!=dev",
+		labels:  map[string]string{"team": "a", "env": "prod"},
+		want:    true,
+	}, {
+		name:    "not included",
+		include: "team in (a,b),env!=dev",
+		labels:  map[string]string{"team": "a", "env": "dev"},
+	}, {
+		name:    "json selector",
+		include: `{"matchLabels":{"team":"a"},"matchExpressions":[{"key":"env","operator":"Exists"}]}`,
+		labels:  map[string]string{"team": "a", "env": "dev"},
+		want:    true,
+	}, {
+		name:    "excluded",
+		include: "team=a",
+		exclude: "env=dev",
+		labels:  map[string]string{"team": "a", "env": "dev"},
+	}, {
+		name:         "excluded, require label",
+		exclude:      "env=dev",
+		requireLabel: true,
+		labels:       map[string]string{InclusionLabel: InclusionValue, "env": "dev"},
+	}, {
+		name:         "include overrides require label",
+		include:      "team=a",
+		requireLabel: true,
+		labels:       map[string]string{"team": "a"},
+		want:         true,
+	}, {
+		name:         "require label",
+		exclude:      "env=dev",
+		requireLabel: true,
+		labels:       map[string]string{InclusionLabel: InclusionValue},
+		want:         true,
+	}}
+	for _, tc := range tests {
+		include, err := ParseSelector(tc.include)
+		if err != nil {
+			t.Fatalf("%q: failed to parse include: %s", tc.name, err)
+		}
+		exclude, err := ParseSelector(tc.exclude)
+		if err != nil {
+			t.Fatalf("%q: failed to parse exclude: %s", tc.name, err)
+		}
+		ctx := WithRequireLabel(context.Background(), tc.requireLabel)
+		ctx = WithNamespaceSelectors(ctx, NamespaceSelectors{Include: include, Exclude: exclude})
+		ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test", Labels: tc.labels}}
+		if got := ShouldProxy(ctx, ns); tc.want != got {
+			t.Errorf("%q want %v got %v", tc.name, tc.want, got)
+		}
+	}
+	if _, err := ParseSelector("team in (a"); err == nil {
+		t.Error("Expected error for bad selector")
+	}
+}
+
+func TestIsExempt(t *testing.T) {
+	namespaces := metav1.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	pods := metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	tests := []struct {
+		name    string
+		exempt  []string
+		request *admissionv1.AdmissionRequest
+		want    string
+	}{{
+		name:    "default, kube-system",
+		request: &admissionv1.AdmissionRequest{Namespace: "kube-system", Resource: pods},
+		want:    "kube-system",
+	}, {
+		name:    "default, OPA namespace",
+		request: &admissionv1.AdmissionRequest{Namespace: "styra-system", Resource: pods},
+		want:    "styra-system",
+	}, {
+		name:    "default, other namespace",
+		request: &admissionv1.AdmissionRequest{Namespace: "default", Resource: pods},
+	}, {
+		name:    "cluster scoped",
+		request: &admissionv1.AdmissionRequest{Name: "kube-system"},
+	}, {
+		name:    "namespace itself",
+		request: &admissionv1.AdmissionRequest{Name: "kube-system", Resource: namespaces},
+		want:    "kube-system",
+	}, {
+		name:    "configured",
+		exempt:  []string{"opa"},
+		request: &admissionv1.AdmissionRequest{Namespace: "opa", Resource: pods},
+		want:    "opa",
+	}, {
+		name:    "configured replaces default",
+		exempt:  []string{"opa"},
+		request: &admissionv1.AdmissionRequest{Namespace: "kube-system", Resource: pods},
+	}}
+	for _, tc := range tests {
+		ctx := context.Background()
+		if tc.exempt != nil {
+			ctx = WithExemptNamespaces(ctx, tc.exempt)
+		}
+		got, ok := IsExempt(ctx, tc.request)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("%q want %q got %q, %v", tc.name, tc.want, got, ok)
+		}
+	}
+}
+
+func TestAllowsHook(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+		wantErr     bool
+	}{{
+		name: "no annotations",
+		want: true,
+	}, {
+		name:        "allowed by name",
+		annotations: map[string]string{AllowHooksAnnotation: "other.webhook, *.sigstore.dev"},
+		want:        true,
+	}, {
+		name:        "allowed by configuration",
+		annotations: map[string]string{AllowHooksAnnotation: "policy-controller/*"},
+		want:        true,
+	}, {
+		name:        "not allowed",
+		annotations: map[string]string{AllowHooksAnnotation: "other.webhook"},
+	}, {
+		name:        "denied",
+		annotations: map[string]string{DenyHooksAnnotation: "*.sigstore.dev"},
+	}, {
+		name: "denied wins",
+		annotations: map[string]string{
+			AllowHooksAnnotation: "*",
+			DenyHooksAnnotation:  "policy-controller/policy.sigstore.dev",
+		},
+	}, {
+		name:        "not denied",
+		annotations: map[string]string{DenyHooksAnnotation: "other.webhook"},
+		want:        true,
+	}, {
+		name:        "bad glob",
+		annotations: map[string]string{AllowHooksAnnotation: "[policy"},
+		wantErr:     true,
+	}}
+	for _, tc := range tests {
+		ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: tc.annotations}}
+		got, err := AllowsHook(ns, "policy-controller", "policy.sigstore.dev")
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q unexpected error: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q want %v got %v", tc.name, tc.want, got)
+		}
+	}
+	if got, err := AllowsHook(nil, "policy-controller", "policy.sigstore.dev"); err != nil || !got {
+		t.Errorf("Cluster scoped requests should allow all hooks, got %v, %v", got, err)
+	}
+}
+
+func TestNamespacesGet(t *testing.T) {
+	cached := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "cached"}}
+	fresh := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fresh"}}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(cached); err != nil {
+		t.Fatalf("Failed to add namespace: %s", err)
+	}
+	client := fakekube.NewSimpleClientset(fresh)
+	ctx := context.Background()
+	n := NewNamespaces(nslisters.NewNamespaceLister(indexer), client.CoreV1(), NamespaceLookupOptions{NegativeCacheTTL: time.Hour})
+
+	if ns, err := n.Get(ctx, "cached"); err != nil || ns.Name != "cached" {
+		t.Errorf("Failed to get cached namespace: %v, %v", ns, err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("Expected no API calls for cached namespace, got %v", client.Actions())
+	}
+	if ns, err := n.Get(ctx, "fresh"); err != nil || ns.Name != "fresh" {
+		t.Errorf("Failed to get fresh namespace: %v, %v", ns, err)
+	}
+
+	client.ClearActions()
+	for i := 0; i < 3; i++ {
+		if _, err := n.Get(ctx, "missing"); !apierrs.IsNotFound(err) {
+			t.Errorf("Expected NotFound, got %v", err)
+		}
+	}
+	if len(client.Actions()) != 1 {
+		t.Errorf("Expected missing namespace to be cached, got %d API calls", len(client.Actions()))
+	}
+
+	// Once the negative cache expires, the namespace is looked up again.
+	if _, err := client.CoreV1().Namespaces().Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "missing"}}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create namespace: %s", err)
+	}
+	n.NegativeCacheTTL = 0
+	if ns, err := n.Get(ctx, "missing"); err != nil || ns.Name != "missing" {
+		t.Errorf("Failed to get created namespace: %v, %v", ns, err)
+	}
+}
+
+func TestShouldProxyClusterScoped(t *testing.T) {
+	namespaces := metav1.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	nodes := metav1.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	object := func(labels string) runtime.RawExtension {
+		return runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"test","labels":` + labels + `}}`)}
+	}
+	included := object(`{"` + InclusionLabel + `":"true"}`)
+	selected, err := ParseSelector("proxy=yes")
+	if err != nil {
+		t.Fatalf("Failed to parse selector: %s", err)
+	}
+	tests := []struct {
+		name         string
+		requireLabel bool
+		opts         ClusterScopedOptions
+		request      *admissionv1.AdmissionRequest
+		want         bool
+	}{{
+		name:    "namespace, no label required",
+		request: &admissionv1.AdmissionRequest{Resource: namespaces, Object: object(`{}`)},
+		want:    true,
+	}, {
+		name:         "namespace, not labeled",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, Object: object(`{}`)},
+	}, {
+		name:         "namespace, labeled",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, Object: included},
+		want:         true,
+	}, {
+		name:         "namespace, label removed",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, Object: object(`{}`), OldObject: included},
+		want:         true,
+	}, {
+		name:         "namespace, deleted",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, OldObject: included},
+		want:         true,
+	}, {
+		name:         "namespace update, label added",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, Name: "test", Namespace: "test", Operation: admissionv1.Update, Object: included, OldObject: object(`{}`)},
+		want:         true,
+	}, {
+		name:         "namespace update, not labeled",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, Name: "test", Namespace: "test", Operation: admissionv1.Update, Object: object(`{}`), OldObject: object(`{}`)},
+	}, {
+		name:         "namespace delete, labeled",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: namespaces, Name: "test", Namespace: "test", Operation: admissionv1.Delete, OldObject: included},
+		want:         true,
+	}, {
+		name:         "cluster scoped, default",
+		requireLabel: true,
+		request:      &admissionv1.AdmissionRequest{Resource: nodes, Object: object(`{}`)},
+		want:         true,
+	}, {
+		name:    "cluster scoped, never",
+		opts:    ClusterScopedOptions{Policy: ClusterScopedNever},
+		request: &admissionv1.AdmissionRequest{Resource: nodes, Object: object(`{"proxy":"yes"}`)},
+	}, {
+		name:    "cluster scoped, selected",
+		opts:    ClusterScopedOptions{Policy: ClusterScopedSelector, Selector: selected},
+		request: &admissionv1.AdmissionRequest{Resource: nodes, Object: object(`{"proxy":"yes"}`)},
+		want:    true,
+	}, {
+		name:    "cluster scoped, not selected",
+		opts:    ClusterScopedOptions{Policy: ClusterScopedSelector, Selector: selected},
+		request: &admissionv1.AdmissionRequest{Resource: nodes, Object: object(`{"proxy":"no"}`)},
+	}}
+	for _, tc := range tests {
+		ctx := WithRequireLabel(context.Background(), tc.requireLabel)
+		ctx = WithClusterScopedOptions(ctx, tc.opts)
+		got, err := ShouldProxyClusterScoped(ctx, tc.request)
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q want %v got %v", tc.name, tc.want, got)
+		}
+	}
+
+	if err := (ClusterScopedOptions{Policy: ClusterScopedSelector}).Validate(); err == nil {
+		t.Error("Expected error for Selector policy without a selector")
+	}
+	if err := (ClusterScopedOptions{Policy: "Sometimes"}).Validate(); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestIsUserExempt(t *testing.T) {
+	rules, err := ParseUserRules(`[
+		{"usernames": ["system:kube-controller-manager"]},
+		{"groups": ["platform:*"], "usernames": ["alice"]},
+		{"serviceAccounts": ["argocd/*"]}
+	]`)
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %s", err)
+	}
+	tests := []struct {
+		name string
+		user authenticationv1.UserInfo
+		want bool
+	}{{
+		name: "username",
+		user: authenticationv1.UserInfo{Username: "system:kube-controller-manager"},
+		want: true,
+	}, {
+		name: "username and group",
+		user: authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated", "platform:admins"}},
+		want: true,
+	}, {
+		name: "username without group",
+		user: authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+	}, {
+		name: "group without username",
+		user: authenticationv1.UserInfo{Username: "bob", Groups: []string{"platform:admins"}},
+	}, {
+		name: "service account",
+		user: authenticationv1.UserInfo{Username: "system:serviceaccount:argocd:argocd-application-controller"},
+		want: true,
+	}, {
+		name: "other service account",
+		user: authenticationv1.UserInfo{Username: "system:serviceaccount:default:argocd"},
+	}, {
+		name: "no user",
+	}}
+	ctx := WithUserRules(context.Background(), rules)
+	for _, tc := range tests {
+		if got := IsUserExempt(ctx, &admissionv1.AdmissionRequest{UserInfo: tc.user}); got != tc.want {
+			t.Errorf("%q want %v got %v", tc.name, tc.want, got)
+		}
+	}
+
+	for _, bad := range []string{`{}`, `[{}]`, `[{"groups": ["[admins"]}]`} {
+		if _, err := ParseUserRules(bad); err == nil {
+			t.Errorf("Expected error parsing %s", bad)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	celFilters, err := ParseCELFilters(`[
+		{"name": "leases", "expression": "request.kind.kind == 'Lease'", "decision": "Skip"},
+		{"name": "enforced", "expression": "namespaceObject != null && has(namespaceObject.metadata.annotations) && namespaceObject.metadata.annotations['enforce'] == 'true'", "decision": "Proxy"}
+	]`)
+	if err != nil {
+		t.Fatalf("Failed to parse CEL filters: %s", err)
+	}
+	ctx := WithRequireLabel(context.Background(), true)
+	ctx = WithUserRules(ctx, []UserRule{{Usernames: []string{"admin"}}})
+	chain, err := NewChain(ctx, DefaultFilters, celFilters)
+	if err != nil {
+		t.Fatalf("Failed to create chain: %s", err)
+	}
+
+	labeled := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "labeled", Labels: map[string]string{InclusionLabel: InclusionValue}}}
+	unlabeled := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}}
+	enforced := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "enforced", Annotations: map[string]string{"enforce": "true"}}}
+	pod := metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	lease := metav1.GroupVersionKind{Group: "coordination.k8s.io", Version: "v1", Kind: "Lease"}
+	namespaceKind := metav1.GroupVersionKind{Version: "v1", Kind: "Namespace"}
+	namespaces := metav1.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	labeledObject := runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"unlabeled","labels":{"` + InclusionLabel + `":"true"}}}`)}
+	unlabeledObject := runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"unlabeled"}}`)}
+	tests := []struct {
+		name         string
+		request      *admissionv1.AdmissionRequest
+		ns           *v1.Namespace
+		wantDecision Decision
+		wantBy       string
+	}{{
+		name:         "labeled",
+		request:      &admissionv1.AdmissionRequest{Namespace: "labeled", Kind: pod},
+		ns:           labeled,
+		wantDecision: Proxy,
+	}, {
+		name:         "unlabeled",
+		request:      &admissionv1.AdmissionRequest{Namespace: "unlabeled", Kind: pod},
+		ns:           unlabeled,
+		wantDecision: Skip,
+		wantBy:       NamespaceFilter,
+	}, {
+		name:         "exempt namespace",
+		request:      &admissionv1.AdmissionRequest{Namespace: "kube-system", Kind: pod},
+		ns:           labeled,
+		wantDecision: Skip,
+		wantBy:       ExemptNamespacesFilter,
+	}, {
+		name:         "exempt user",
+		request:      &admissionv1.AdmissionRequest{Namespace: "labeled", Kind: pod, UserInfo: authenticationv1.UserInfo{Username: "admin"}},
+		ns:           labeled,
+		wantDecision: Skip,
+		wantBy:       UsersFilter,
+	}, {
+		name:         "cel skip",
+		request:      &admissionv1.AdmissionRequest{Namespace: "labeled", Kind: lease},
+		ns:           labeled,
+		wantDecision: Skip,
+		wantBy:       "cel:leases",
+	}, {
+		name:         "cel proxy before namespace",
+		request:      &admissionv1.AdmissionRequest{Namespace: "enforced", Kind: pod},
+		ns:           enforced,
+		wantDecision: Proxy,
+		wantBy:       "cel:enforced",
+	}, {
+		name:         "cluster scoped",
+		request:      &admissionv1.AdmissionRequest{Kind: metav1.GroupVersionKind{Version: "v1", Kind: "Node"}},
+		wantDecision: Proxy,
+	}, {
+		name: "namespace update adding the label",
+		request: &admissionv1.AdmissionRequest{
+			Namespace: "unlabeled", Name: "unlabeled", Kind: namespaceKind, Resource: namespaces, Operation: admissionv1.Update,
+			Object: labeledObject, OldObject: unlabeledObject,
+		},
+		ns:           unlabeled,
+		wantDecision: Proxy,
+	}, {
+		name: "namespace update without the label",
+		request: &admissionv1.AdmissionRequest{
+			Namespace: "unlabeled", Name: "unlabeled", Kind: namespaceKind, Resource: namespaces, Operation: admissionv1.Update,
+			Object: unlabeledObject, OldObject: unlabeledObject,
+		},
+		ns:           labeled,
+		wantDecision: Skip,
+		wantBy:       ClusterScopedFilter,
+	}, {
+		name: "namespace delete",
+		request: &admissionv1.AdmissionRequest{
+			Namespace: "unlabeled", Name: "unlabeled", Kind: namespaceKind, Resource: namespaces, Operation: admissionv1.Delete,
+			OldObject: labeledObject,
+		},
+		ns:           unlabeled,
+		wantDecision: Proxy,
+	}}
+	for _, tc := range tests {
+		decision, by, err := chain.Decide(context.Background(), tc.request, namespaceGetter(tc.ns))
+		if err != nil {
+			t.Errorf("%q unexpected error: %s", tc.name, err)
+		}
+		if decision != tc.wantDecision || by != tc.wantBy {
+			t.Errorf("%q want %s by %q got %s by %q", tc.name, tc.wantDecision, tc.wantBy, decision, by)
+		}
+	}
+
+	// Exempt requests are skipped without getting the namespace.
+	lookupErr := errors.New("lookup failed")
+	failing := func() (*v1.Namespace, error) {
+		return nil, lookupErr
+	}
+	for _, request := range []*admissionv1.AdmissionRequest{
+		{Namespace: "kube-system", Kind: pod},
+		{Namespace: "labeled", Kind: pod, UserInfo: authenticationv1.UserInfo{Username: "admin"}},
+	} {
+		if decision, _, err := chain.Decide(context.Background(), request, failing); err != nil || decision != Skip {
+			t.Errorf("%s by %q: want Skip got %s, %v", request.Namespace, request.UserInfo.Username, decision, err)
+		}
+	}
+	if _, _, err := chain.Decide(context.Background(), &admissionv1.AdmissionRequest{Namespace: "labeled", Kind: pod}, failing); !errors.Is(err, lookupErr) {
+		t.Errorf("Expected the lookup error, got %v", err)
+	}
+
+	// The CEL filters share the variables made for the request.
+	r := NewRequest(&admissionv1.AdmissionRequest{Namespace: "labeled", Kind: pod})
+	first, err := r.celVars(labeled)
+	if err != nil {
+		t.Fatalf("Failed to create variables: %s", err)
+	}
+	if again, err := r.celVars(labeled); err != nil || reflect.ValueOf(again).Pointer() != reflect.ValueOf(first).Pointer() {
+		t.Errorf("Wanted the variables made once, got %v", err)
+	}
+
+	if _, err := NewChain(ctx, []string{"nope"}, nil); err == nil {
+		t.Error("Expected error for unknown filter")
+	}
+	for _, bad := range []string{
+		`[{"name": "x", "expression": "request.kind.kind ==", "decision": "Skip"}]`,
+		`[{"name": "x", "expression": "'not a bool'", "decision": "Skip"}]`,
+		`[{"name": "x", "expression": "true", "decision": "Maybe"}]`,
+		`[{"expression": "true", "decision": "Skip"}]`,
+	} {
+		if _, err := ParseCELFilters(bad); err == nil {
+			t.Errorf("Expected error parsing %s", bad)
+		}
+	}
+}
+
+// namespaceGetter returns a NamespaceGetter for ns.
+func namespaceGetter(ns *v1.Namespace) NamespaceGetter {
+	return func() (*v1.Namespace, error) {
+		return ns, nil
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Annotations on a namespace with comma separated globs of the hooks to call
+// for requests in it. The globs are matched against both <webhook> and
+// <configuration>/<webhook>. Hooks matching DenyHooksAnnotation are never
+// called, and when AllowHooksAnnotation is set only the hooks matching it
+// are.
+const (
+	AllowHooksAnnotation = "proxy.chainguard.dev/allow-hooks"
+	DenyHooksAnnotation  = "proxy.chainguard.dev/deny-hooks"
+)
+
+// AllowsHook returns whether the annotations of the namespace allow calling
+// the webhook of the given configuration. A nil namespace, for cluster scoped
+// requests, allows all of them.
+func AllowsHook(ns *v1.Namespace, configuration, webhook string) (bool, error) {
+	if ns == nil {
+		return true, nil
+	}
+	if deny, ok := ns.Annotations[DenyHooksAnnotation]; ok {
+		denied, err := matchesHook(deny, configuration, webhook)
+		if err != nil || denied {
+			return false, err
+		}
+	}
+	if allow, ok := ns.Annotations[AllowHooksAnnotation]; ok {
+		return matchesHook(allow, configuration, webhook)
+	}
+	return true, nil
+}
+
+func matchesHook(globs, configuration, webhook string) (bool, error) {
+	for _, glob := range strings.Split(globs, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		nameMatch, err := path.Match(glob, webhook)
+		if err != nil {
+			return false, fmt.Errorf("invalid hook glob %q: %w", glob, err)
+		}
+		qualifiedMatch, _ := path.Match(glob, configuration+"/"+webhook)
+		if nameMatch || qualifiedMatch {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	nslisters "k8s.io/client-go/listers/core/v1"
+	"knative.dev/pkg/logging"
+)
+
+// DefaultNegativeCacheTTL is how long namespaces that were not found on the
+// API server are remembered as missing by default.
+const DefaultNegativeCacheTTL = 5 * time.Second
+
+// NamespaceLookupOptions control what happens when the namespace of a
+// request is not in the informer cache.
+type NamespaceLookupOptions struct {
+	// FailurePolicy says what to do with requests whose namespace can not
+	// be found. Empty is treated as Fail.
+	FailurePolicy admissionregistrationv1.FailurePolicyType
+	// NegativeCacheTTL is how long a namespace not found on the API server
+	// is remembered as missing, so a burst of requests for it does not turn
+	// into a burst of GETs.
+	NegativeCacheTTL time.Duration
+}
+
+// namespaceLookupKey is used as the key for associating the
+// NamespaceLookupOptions with the context.
+type namespaceLookupKey struct{}
+
+// WithNamespaceLookupOptions sets the NamespaceLookupOptions.
+func WithNamespaceLookupOptions(ctx context.Context, opts NamespaceLookupOptions) context.Context {
+	return context.WithValue(ctx, namespaceLookupKey{}, opts)
+}
+
+// GetNamespaceLookupOptions retrieves the NamespaceLookupOptions associated
+// with the given context via WithNamespaceLookupOptions (above).
+func GetNamespaceLookupOptions(ctx context.Context) NamespaceLookupOptions {
+	v := ctx.Value(namespaceLookupKey{})
+	if v == nil {
+		return NamespaceLookupOptions{NegativeCacheTTL: DefaultNegativeCacheTTL}
+	}
+	return v.(NamespaceLookupOptions)
+}
+
+// Namespaces gets namespaces from the informer cache, and from the API server
+// for the ones that are not in the cache yet, like freshly created ones.
+type Namespaces struct {
+	NamespaceLookupOptions
+	lister nslisters.NamespaceLister
+	client corev1client.NamespacesGetter
+
+	m sync.Mutex
+	// missing has when namespaces not found on the API server were looked
+	// up.
+	missing map[string]time.Time
+}
+
+// NewNamespaces returns Namespaces that fall back to the client when the
+// lister does not have the namespace.
+func NewNamespaces(lister nslisters.NamespaceLister, client corev1client.NamespacesGetter, opts NamespaceLookupOptions) *Namespaces {
+	return &Namespaces{
+		NamespaceLookupOptions: opts,
+		lister:                 lister,
+		client:                 client,
+		missing:                make(map[string]time.Time),
+	}
+}
+
+// Get returns the namespace with the given name.
+func (n *Namespaces) Get(ctx context.Context, name string) (*v1.Namespace, error) {
+	ns, err := n.lister.Get(name)
+	if !apierrs.IsNotFound(err) {
+		return ns, err
+	}
+	n.m.Lock()
+	at, ok := n.missing[name]
+	n.m.Unlock()
+	if ok && time.Since(at) < n.NegativeCacheTTL {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debugf("Namespace %s not in the cache, getting it from the API server", name)
+	ns, err = n.client.Namespaces().Get(ctx, name, metav1.GetOptions{})
+	n.m.Lock()
+	defer n.m.Unlock()
+	if apierrs.IsNotFound(err) {
+		// Forget the expired ones while we are at it, so this does not grow
+		// forever.
+		for k, at := range n.missing {
+			if time.Since(at) >= n.NegativeCacheTTL {
+				delete(n.missing, k)
+			}
+		}
+		n.missing[name] = time.Now()
+	} else {
+		delete(n.missing, name)
+	}
+	return ns, err
+}
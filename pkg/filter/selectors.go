@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NamespaceSelectors decide which namespaces are proxied by their labels.
+type NamespaceSelectors struct {
+	// Include selects the namespaces to proxy. If nil, whether the
+	// InclusionLabel is required decides, see WithRequireLabel.
+	Include labels.Selector
+	// Exclude selects namespaces not to proxy, even if Include selects
+	// them. If nil, no namespaces are excluded.
+	Exclude labels.Selector
+}
+
+// ParseSelector parses a metav1.LabelSelector, either as JSON with
+// matchLabels and matchExpressions, or in the kubectl syntax, for example
+// "team in (a,b),env!=dev". Empty returns nil, and not an empty selector
+// which would select everything.
+func ParseSelector(s string) (labels.Selector, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "{") {
+		return labels.Parse(s)
+	}
+	ls := &metav1.LabelSelector{}
+	if err := json.Unmarshal([]byte(s), ls); err != nil {
+		return nil, err
+	}
+	return metav1.LabelSelectorAsSelector(ls)
+}
+
+// namespaceSelectorsKey is used as the key for associating the
+// NamespaceSelectors with the context.
+type namespaceSelectorsKey struct{}
+
+// WithNamespaceSelectors sets the selectors of the namespaces to proxy.
+func WithNamespaceSelectors(ctx context.Context, selectors NamespaceSelectors) context.Context {
+	return context.WithValue(ctx, namespaceSelectorsKey{}, selectors)
+}
+
+// GetNamespaceSelectors retrieves the NamespaceSelectors associated with the
+// given context via WithNamespaceSelectors (above).
+func GetNamespaceSelectors(ctx context.Context) NamespaceSelectors {
+	v := ctx.Value(namespaceSelectorsKey{})
+	if v == nil {
+		return NamespaceSelectors{}
+	}
+	return v.(NamespaceSelectors)
+}
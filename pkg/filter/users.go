@@ -0,0 +1,140 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"knative.dev/pkg/logging"
+)
+
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// UserRule exempts requests made by the users it matches. Each field is a
+// list of globs, and the rule matches when every field that is set has a
+// glob matching the user.
+type UserRule struct {
+	// Usernames matched against the username.
+	Usernames []string `json:"usernames,omitempty"`
+	// Groups matched against each of the groups of the user.
+	Groups []string `json:"groups,omitempty"`
+	// ServiceAccounts matched against <namespace>/<name> of service account
+	// users.
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+// ParseUserRules parses a JSON list of UserRules.
+func ParseUserRules(s string) ([]UserRule, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var rules []UserRule
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if len(rule.Usernames) == 0 && len(rule.Groups) == 0 && len(rule.ServiceAccounts) == 0 {
+			return nil, fmt.Errorf("rule %d matches nothing", i)
+		}
+		for _, globs := range [][]string{rule.Usernames, rule.Groups, rule.ServiceAccounts} {
+			for _, glob := range globs {
+				if _, err := path.Match(glob, ""); err != nil {
+					return nil, fmt.Errorf("rule %d: invalid glob %q: %w", i, glob, err)
+				}
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Matches returns whether the rule matches the user.
+func (r UserRule) Matches(user authenticationv1.UserInfo) bool {
+	if len(r.Usernames) == 0 && len(r.Groups) == 0 && len(r.ServiceAccounts) == 0 {
+		return false
+	}
+	if len(r.Usernames) > 0 && !matchesAny(r.Usernames, user.Username) {
+		return false
+	}
+	if len(r.Groups) > 0 {
+		matched := false
+		for _, group := range user.Groups {
+			if matchesAny(r.Groups, group) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.ServiceAccounts) > 0 {
+		sa, ok := serviceAccount(user.Username)
+		if !ok || !matchesAny(r.ServiceAccounts, sa) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsUserExempt returns whether the request was made by a user exempted by
+// one of the rules set with WithUserRules. Exempted requests are logged, so
+// there is an audit trail of what got around the proxy.
+func IsUserExempt(ctx context.Context, request *admissionv1.AdmissionRequest) bool {
+	for i, rule := range GetUserRules(ctx) {
+		if rule.Matches(request.UserInfo) {
+			logging.FromContext(ctx).Infof("Audit: exempted %s of %s %s/%s (uid %s) by user %q in groups %v, matched user rule %d",
+				request.Operation, request.Resource.Resource, request.Namespace, request.Name, request.UID, request.UserInfo.Username, request.UserInfo.Groups, i)
+			return true
+		}
+	}
+	return false
+}
+
+// serviceAccount returns <namespace>/<name> for service account usernames.
+func serviceAccount(username string) (string, bool) {
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[0] + "/" + parts[1], true
+}
+
+func matchesAny(globs []string, s string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// userRulesKey is used as the key for associating the UserRules with the
+// context.
+type userRulesKey struct{}
+
+// WithUserRules sets the rules of the users whose requests are not proxied.
+func WithUserRules(ctx context.Context, rules []UserRule) context.Context {
+	return context.WithValue(ctx, userRulesKey{}, rules)
+}
+
+// GetUserRules retrieves the UserRules associated with the given context via
+// WithUserRules (above).
+func GetUserRules(ctx context.Context) []UserRule {
+	v := ctx.Value(userRulesKey{})
+	if v == nil {
+		return nil
+	}
+	return v.([]UserRule)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// breaker is a circuit breaker guarding calls to a single delegate. It opens
+// after a number of consecutive failures and then fails fast until the
+// cooldown has passed, at which point a single probe is let through. If the
+// probe succeeds the breaker closes again, otherwise it reopens.
+type breaker struct {
+	m        sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// allow reports whether a call may go through, and if that caused a state
+// change, what the new state is.
+func (b *breaker) allow(now time.Time, cooldown time.Duration) (bool, breakerState, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cooldown {
+			return false, b.state, false
+		}
+		// Let this one through as the probe, and fail everybody else fast
+		// until we know how it went.
+		b.state = breakerHalfOpen
+		return true, b.state, true
+	case breakerHalfOpen:
+		return false, b.state, false
+	}
+	return true, b.state, false
+}
+
+// done records the outcome of a call that was allowed through. A threshold
+// of 0 means the breaker never opens. Returns the new state and whether it
+// changed.
+func (b *breaker) done(now time.Time, success bool, threshold int) (breakerState, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	old := b.state
+	if success {
+		b.failures = 0
+		b.state = breakerClosed
+		return b.state, old != b.state
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (threshold > 0 && b.failures >= threshold) {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+	return b.state, old != b.state
+}
+
+// cancel gives up on a call that was allowed through without recording an
+// outcome. If it was the half-open probe, the breaker goes back to open so
+// that the next call probes again.
+func (b *breaker) cancel() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+)
+
+var (
+	admissionV1      = admissionv1.SchemeGroupVersion.String()
+	admissionV1beta1 = admissionv1beta1.SchemeGroupVersion.String()
+)
+
+// NegotiateReviewVersion picks the AdmissionReview version to talk to a
+// delegate with from its AdmissionReviewVersions. Like the kube-apiserver, the
+// first one we support wins.
+func NegotiateReviewVersion(versions []string) (string, error) {
+	if len(versions) == 0 {
+		return admissionV1, nil
+	}
+	for _, v := range versions {
+		switch v {
+		case "v1", admissionV1:
+			return admissionV1, nil
+		case "v1beta1", admissionV1beta1:
+			return admissionV1beta1, nil
+		}
+	}
+	return "", fmt.Errorf("none of the AdmissionReviewVersions %v are supported, need one of v1, v1beta1", versions)
+}
+
+// toV1beta1Request converts the request for a delegate that only speaks
+// v1beta1.
+func toV1beta1Request(in *admissionv1.AdmissionRequest) *admissionv1beta1.AdmissionRequest {
+	if in == nil {
+		return nil
+	}
+	return &admissionv1beta1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1beta1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+// fromV1beta1Review converts the review we got back from a v1beta1 delegate
+// so that the rest of the proxy only has to deal with v1. The TypeMeta is
+// kept as is so that it can still be validated against what was sent.
+func fromV1beta1Review(in *admissionv1beta1.AdmissionReview) *admissionv1.AdmissionReview {
+	ret := &admissionv1.AdmissionReview{TypeMeta: in.TypeMeta}
+	if in.Response == nil {
+		return ret
+	}
+	ret.Response = &admissionv1.AdmissionResponse{
+		UID:              in.Response.UID,
+		Allowed:          in.Response.Allowed,
+		Result:           in.Response.Result,
+		Patch:            in.Response.Patch,
+		AuditAnnotations: in.Response.AuditAnnotations,
+		Warnings:         in.Response.Warnings,
+	}
+	if in.Response.PatchType != nil {
+		pt := admissionv1.PatchType(*in.Response.PatchType)
+		ret.Response.PatchType = &pt
+	}
+	return ret
+}
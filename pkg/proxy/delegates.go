@@ -0,0 +1,158 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNoDelegate is returned when there is no webhook for the path.
+	ErrNoDelegate = errors.New("no webhook found")
+	// ErrAmbiguousDelegate is returned when a webhook is asked for by name
+	// only, and more than one webhook configuration has a webhook by that
+	// name.
+	ErrAmbiguousDelegate = errors.New("webhook name is ambiguous")
+)
+
+// Delegates keeps track of the Delegates for each webhook, by the name of
+// the webhook configuration they belong to. It is safe for concurrent use.
+type Delegates struct {
+	m        sync.Mutex
+	byConfig map[string]map[string]*Delegate
+}
+
+// NewDelegates creates an empty Delegates.
+func NewDelegates() *Delegates {
+	return &Delegates{byConfig: make(map[string]map[string]*Delegate)}
+}
+
+// Add adds or replaces the Delegate for the webhook d.Name in the webhook
+// configuration d.Configuration. The pooled transport of the Delegate being
+// replaced is reused if possible, and closed otherwise.
+func (ds *Delegates) Add(d *Delegate) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	hooks, ok := ds.byConfig[d.Configuration]
+	if !ok {
+		hooks = make(map[string]*Delegate)
+		ds.byConfig[d.Configuration] = hooks
+	}
+	if old := hooks[d.Name]; !d.ReuseTransport(old) {
+		// New webhook, or its endpoint or CABundle changed, so drop the
+		// connections to the old one and open a transport of our own.
+		old.Close()
+		d.connect()
+	}
+	hooks[d.Name] = d
+}
+
+// Lookup finds the Delegate for a path of the form <configuration>/<webhook>
+// or just <webhook>. The latter is only allowed if the webhook name is
+// unique across all the webhook configurations.
+func (ds *Delegates) Lookup(path string) (*Delegate, error) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	config, hook, qualified := strings.Cut(strings.Trim(path, "/"), "/")
+	if qualified {
+		if d := ds.byConfig[config][hook]; d != nil && d.Service != "" {
+			return d, nil
+		}
+		return nil, fmt.Errorf("%w: %s in configuration %s", ErrNoDelegate, hook, config)
+	}
+	// Not qualified, so config is really the name of the webhook.
+	hook = config
+	var found *Delegate
+	var configs []string
+	for name, hooks := range ds.byConfig {
+		if d := hooks[hook]; d != nil && d.Service != "" {
+			found = d
+			configs = append(configs, name)
+		}
+	}
+	switch len(configs) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrNoDelegate, hook)
+	case 1:
+		return found, nil
+	}
+	sort.Strings(configs)
+	return nil, fmt.Errorf("%w: %s is in configurations %s, use <configuration>/%s", ErrAmbiguousDelegate, hook, strings.Join(configs, ", "), hook)
+}
+
+// Prune removes the Delegates of the webhook configuration for webhooks not
+// in keep, closing their idle connections. With nothing to keep, the whole
+// configuration is removed. Returns the names of the removed webhooks.
+func (ds *Delegates) Prune(config string, keep ...string) []string {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	hooks, ok := ds.byConfig[config]
+	if !ok {
+		return nil
+	}
+	keepers := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		keepers[name] = true
+	}
+	var removed []string
+	for name, d := range hooks {
+		if keepers[name] {
+			continue
+		}
+		delete(hooks, name)
+		if !ds.inUse(d) {
+			d.Close()
+		}
+		removed = append(removed, name)
+	}
+	if len(hooks) == 0 {
+		delete(ds.byConfig, config)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// inUse checks if the transport of d is shared with any of the Delegates we
+// still have. Callers must hold the lock.
+func (ds *Delegates) inUse(d *Delegate) bool {
+	for _, hooks := range ds.byConfig {
+		for _, other := range hooks {
+			if other.transport != nil && other.transport == d.transport {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// All returns all the Delegates in the order the kube-apiserver calls them,
+// that is ordered by configuration and then by their place in it.
+func (ds *Delegates) All() []*Delegate {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	var ret []*Delegate
+	for _, hooks := range ds.byConfig {
+		for _, d := range hooks {
+			if d.Service != "" {
+				ret = append(ret, d)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Configuration != ret[j].Configuration {
+			return ret[i].Configuration < ret[j].Configuration
+		}
+		if ret[i].Index != ret[j].Index {
+			return ret[i].Index < ret[j].Index
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
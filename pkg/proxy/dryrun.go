@@ -0,0 +1,63 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typesv1 "k8s.io/apimachinery/pkg/types"
+)
+
+// DryRunParam is the query parameter callers can set to "true" to have the
+// request sent to delegates as a dry run, whatever the request says, so that
+// speculative calls never cause side effects.
+const DryRunParam = "dryRun"
+
+// ForceDryRun returns the request with DryRun set if the caller asked for it
+// with the DryRunParam, otherwise the request as is.
+func ForceDryRun(req *http.Request, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if req == nil {
+		return request
+	}
+	if force, _ := strconv.ParseBool(req.URL.Query().Get(DryRunParam)); !force || isDryRun(request) {
+		return request
+	}
+	ret := request.DeepCopy()
+	dryRun := true
+	ret.DryRun = &dryRun
+	return ret
+}
+
+// SupportsDryRun returns whether the delegate can be called with dry run
+// requests, which is only the case when it says it has no side effects.
+// Empty is treated as Unknown.
+func (d *Delegate) SupportsDryRun() bool {
+	return d.SideEffects == v1.SideEffectClassNone || d.SideEffects == v1.SideEffectClassNoneOnDryRun
+}
+
+// CreateDryRunUnsupportedResponse is returned for dry run requests to
+// delegates that may have side effects. Same as the kube-apiserver, the
+// request is rejected whatever the FailurePolicy of the delegate.
+func CreateDryRunUnsupportedResponse(uid typesv1.UID, webhook string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		UID:     uid,
+		Allowed: false,
+		Result: &metav1.Status{
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: fmt.Sprintf("admission webhook %q does not support dry run", webhook),
+		},
+	}
+}
+
+func isDryRun(request *admissionv1.AdmissionRequest) bool {
+	return request.DryRun != nil && *request.DryRun
+}
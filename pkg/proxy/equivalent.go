@@ -0,0 +1,272 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"knative.dev/pkg/logging"
+)
+
+// errNoConversion is returned when the object of a request can not be
+// converted to an equivalent resource.
+var errNoConversion = errors.New("no conversion")
+
+// equivalentRefreshInterval is the least amount of time between refreshing
+// the discovery data when a resource can not be found.
+const equivalentRefreshInterval = time.Minute
+
+// movedGroups lists the built in resources that are served from more than
+// one group, which discovery alone can not tell us.
+var movedGroups = map[schema.GroupResource][]string{
+	{Group: "extensions", Resource: "deployments"}:            {"apps"},
+	{Group: "extensions", Resource: "daemonsets"}:             {"apps"},
+	{Group: "extensions", Resource: "replicasets"}:            {"apps"},
+	{Group: "extensions", Resource: "ingresses"}:              {"networking.k8s.io"},
+	{Group: "extensions", Resource: "networkpolicies"}:        {"networking.k8s.io"},
+	{Group: "extensions", Resource: "podsecuritypolicies"}:    {"policy"},
+	{Group: "apps", Resource: "deployments"}:                  {"extensions"},
+	{Group: "apps", Resource: "daemonsets"}:                   {"extensions"},
+	{Group: "apps", Resource: "replicasets"}:                  {"extensions"},
+	{Group: "networking.k8s.io", Resource: "ingresses"}:       {"extensions"},
+	{Group: "networking.k8s.io", Resource: "networkpolicies"}: {"extensions"},
+	{Group: "policy", Resource: "podsecuritypolicies"}:        {"extensions"},
+}
+
+// sameSchema lists the kinds that are served from more than one group with
+// the same schema, so their objects are converted by just changing their
+// apiVersion. Other equivalent kinds, like the versions of
+// HorizontalPodAutoscalers, differ in their fields and would need the
+// conversions of the kube-apiserver, which we do not have.
+var sameSchema = [][]schema.GroupVersionKind{{
+	{Group: "extensions", Version: "v1beta1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1beta1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1beta2", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+}, {
+	{Group: "extensions", Version: "v1beta1", Kind: "DaemonSet"},
+	{Group: "apps", Version: "v1beta2", Kind: "DaemonSet"},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+}, {
+	{Group: "extensions", Version: "v1beta1", Kind: "ReplicaSet"},
+	{Group: "apps", Version: "v1beta2", Kind: "ReplicaSet"},
+	{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+}, {
+	{Group: "extensions", Version: "v1beta1", Kind: "Ingress"},
+	{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"},
+}, {
+	{Group: "extensions", Version: "v1beta1", Kind: "NetworkPolicy"},
+	{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"},
+}, {
+	{Group: "extensions", Version: "v1beta1", Kind: "PodSecurityPolicy"},
+	{Group: "policy", Version: "v1beta1", Kind: "PodSecurityPolicy"},
+}}
+
+// EquivalentResource is a resource that is equivalent to the one in the
+// request, along with its kind.
+type EquivalentResource struct {
+	Resource metav1.GroupVersionResource
+	Kind     metav1.GroupVersionKind
+}
+
+// EquivalentResources uses discovery to find resources that are equivalent
+// to each other, that is the same resource served at different versions, or
+// from different groups. It is safe for concurrent use.
+type EquivalentResources struct {
+	discovery discovery.CachedDiscoveryInterface
+
+	m         sync.Mutex
+	refreshed time.Time
+}
+
+// NewEquivalentResources creates EquivalentResources caching the discovery
+// data of the given client.
+func NewEquivalentResources(client discovery.DiscoveryInterface) *EquivalentResources {
+	return &EquivalentResources{discovery: memory.NewMemCacheClient(client)}
+}
+
+// For returns the resources that are equivalent to the given one, not
+// including itself.
+func (e *EquivalentResources) For(gvr metav1.GroupVersionResource, subResource string) ([]EquivalentResource, error) {
+	ret, found, err := e.lookup(gvr, subResource)
+	if err != nil || found {
+		return ret, err
+	}
+	// Maybe the resource is new, refresh the discovery data, but not too
+	// often since the resource might just not exist.
+	e.m.Lock()
+	if time.Since(e.refreshed) < equivalentRefreshInterval {
+		e.m.Unlock()
+		return ret, nil
+	}
+	e.refreshed = time.Now()
+	e.m.Unlock()
+	e.discovery.Invalidate()
+	ret, _, err = e.lookup(gvr, subResource)
+	return ret, err
+}
+
+// lookup finds the equivalent resources, and whether the resource itself was
+// found in discovery.
+func (e *EquivalentResources) lookup(gvr metav1.GroupVersionResource, subResource string) ([]EquivalentResource, bool, error) {
+	_, lists, err := e.discovery.ServerGroupsAndResources()
+	if err != nil && len(lists) == 0 {
+		return nil, false, fmt.Errorf("failed to discover resources: %w", err)
+	}
+	name := gvr.Resource
+	if subResource != "" {
+		name = gvr.Resource + "/" + subResource
+	}
+	groups := append([]string{gvr.Group}, movedGroups[schema.GroupResource{Group: gvr.Group, Resource: gvr.Resource}]...)
+	var ret []EquivalentResource
+	found := false
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil || !contains(groups, gv.Group) {
+			continue
+		}
+		for _, r := range list.APIResources {
+			if r.Name != name {
+				continue
+			}
+			if gv.Group == gvr.Group && gv.Version == gvr.Version {
+				found = true
+				continue
+			}
+			// For subresources the kind is that of the subresource, so get
+			// the kind of the resource itself.
+			kind := r.Kind
+			if subResource != "" {
+				kind = resourceKind(list.APIResources, gvr.Resource, kind)
+			}
+			ret = append(ret, EquivalentResource{
+				Resource: metav1.GroupVersionResource{Group: gv.Group, Version: gv.Version, Resource: gvr.Resource},
+				Kind:     metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: kind},
+			})
+		}
+	}
+	return ret, found, nil
+}
+
+func resourceKind(resources []metav1.APIResource, name, fallback string) string {
+	for _, r := range resources {
+		if r.Name == name {
+			return r.Kind
+		}
+	}
+	return fallback
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchEquivalent returns the request to send to the webhook. If the rules
+// of the webhook do not match the request, but do match an equivalent
+// resource and the MatchPolicy is Equivalent, the request is converted to
+// that resource like the kube-apiserver does, with the original resource in
+// RequestKind and RequestResource. Otherwise the request is returned as is,
+// including when its object can not be converted, so that it is not matched.
+//
+// Mutating delegates are always matched as if their MatchPolicy was Exact,
+// since their patches would be for the converted object, which we can not
+// convert back to the one in the request.
+func (d *Delegate) MatchEquivalent(ctx context.Context, request *admissionv1.AdmissionRequest, equivalents *EquivalentResources) (*admissionv1.AdmissionRequest, error) {
+	if equivalents == nil || d.MatchPolicy == v1.Exact || d.Mutating || d.MatchesRules(request) {
+		return request, nil
+	}
+	candidates, err := equivalents.For(request.Resource, request.SubResource)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range candidates {
+		converted := request.DeepCopy()
+		converted.Resource = c.Resource
+		converted.Kind = c.Kind
+		if !d.MatchesRules(converted) {
+			continue
+		}
+		if converted.RequestKind == nil {
+			converted.RequestKind = request.Kind.DeepCopy()
+		}
+		if converted.RequestResource == nil {
+			converted.RequestResource = request.Resource.DeepCopy()
+			converted.RequestSubResource = request.SubResource
+		}
+		if request.SubResource == "" {
+			from := schema.GroupVersionKind(request.Kind)
+			to := schema.GroupVersionKind(c.Kind)
+			converted.Object, err = convertObject(request.Object, from, to)
+			if err == nil {
+				converted.OldObject, err = convertObject(request.OldObject, from, to)
+			}
+			if errors.Is(err, errNoConversion) {
+				logging.FromContext(ctx).Debugf("Not sending request for %s to %s as equivalent %s: %s", request.Resource.String(), d.Name, c.Resource.String(), err)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert object to %s: %w", to, err)
+			}
+		}
+		logging.FromContext(ctx).Debugf("Converted request for %s to equivalent %s for %s", request.Resource.String(), c.Resource.String(), d.Name)
+		return converted, nil
+	}
+	return request, nil
+}
+
+// convertObject converts the object to the given kind if both kinds have the
+// same schema, see sameSchema. Otherwise it fails with errNoConversion.
+func convertObject(raw runtime.RawExtension, from, to schema.GroupVersionKind) (runtime.RawExtension, error) {
+	if len(raw.Raw) == 0 {
+		return raw, nil
+	}
+	if !haveSameSchema(from, to) {
+		return raw, fmt.Errorf("%w from %s to %s", errNoConversion, from, to)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(raw.Raw, obj); err != nil {
+		return raw, err
+	}
+	obj.SetGroupVersionKind(to)
+	b, err := json.Marshal(obj)
+	return runtime.RawExtension{Raw: b}, err
+}
+
+func haveSameSchema(from, to schema.GroupVersionKind) bool {
+	for _, kinds := range sameSchema {
+		if containsKind(kinds, from) && containsKind(kinds, to) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKind(kinds []schema.GroupVersionKind, kind schema.GroupVersionKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typesv1 "k8s.io/apimachinery/pkg/types"
+	"knative.dev/pkg/logging"
+)
+
+// WebhooksParam is the query parameter that restricts which webhooks are
+// called to the ones whose name matches one of its comma separated globs.
+// The globs are matched against both <webhook> and <configuration>/<webhook>.
+const WebhooksParam = "webhooks"
+
+// Call is a request to be sent to a delegate.
+type Call struct {
+	Delegate *Delegate
+	Request  *admissionv1.AdmissionRequest
+}
+
+// Result is the response of a delegate to a Call.
+type Result struct {
+	Delegate *Delegate
+	Response *admissionv1.AdmissionResponse
+}
+
+// SelectDelegates returns the delegates whose names match the globs in the
+// WebhooksParam of the request, or all of them if there is no such parameter.
+func SelectDelegates(req *http.Request, delegates []*Delegate) ([]*Delegate, error) {
+	if req == nil || req.URL.Query().Get(WebhooksParam) == "" {
+		return delegates, nil
+	}
+	globs := strings.Split(req.URL.Query().Get(WebhooksParam), ",")
+	var ret []*Delegate
+	for _, d := range delegates {
+		for _, glob := range globs {
+			nameMatch, err := path.Match(glob, d.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s glob %q: %w", WebhooksParam, glob, err)
+			}
+			qualifiedMatch, _ := path.Match(glob, d.QualifiedName())
+			if nameMatch || qualifiedMatch {
+				ret = append(ret, d)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// KeepDelegates returns the delegates for which keep returns true, or the
+// first error it returns.
+func KeepDelegates(delegates []*Delegate, keep func(*Delegate) (bool, error)) ([]*Delegate, error) {
+	ret := make([]*Delegate, 0, len(delegates))
+	for _, d := range delegates {
+		ok, err := keep(d)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ret = append(ret, d)
+		}
+	}
+	return ret, nil
+}
+
+// Calls returns the calls to make to the delegates that match the request.
+// Delegates for which we can not tell if they match get the ErrorResponse for
+// that instead, as if they had been called.
+func Calls(ctx context.Context, request *admissionv1.AdmissionRequest, ns *corev1.Namespace, delegates []*Delegate, equivalents *EquivalentResources) ([]Call, []Result) {
+	var calls []Call
+	var failed []Result
+	for _, d := range delegates {
+		forward, reason, err := d.MatchRequest(ctx, request, ns, equivalents)
+		if err != nil {
+			failed = append(failed, Result{Delegate: d, Response: d.ErrorResponse(ctx, request.UID, err)})
+			continue
+		}
+		if reason != "" {
+			logging.FromContext(ctx).Debugf("Request not matched by the %s of %s/%s, skipping", reason, d.Configuration, d.Name)
+			continue
+		}
+		calls = append(calls, Call{Delegate: d, Request: forward})
+	}
+	return calls, failed
+}
+
+// FanOut makes all the calls at the same time, and waits for all of them to
+// finish or for the longest timeout of the delegates called to pass,
+// whichever comes first. Results are in the same order as the calls.
+func FanOut(ctx context.Context, calls []Call) []Result {
+	var timeout time.Duration
+	for _, c := range calls {
+		if t := c.Delegate.timeout(); t > timeout {
+			timeout = t
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := make([]Result, len(calls))
+	var wg sync.WaitGroup
+	for i := range calls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = Result{
+				Delegate: calls[i].Delegate,
+				Response: DoRequest(ctx, calls[i].Delegate, calls[i].Request),
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// Aggregate combines the responses of several webhooks into one, the way the
+// kube-apiserver would see them: the request is only allowed if all of them
+// allow it. Denial messages, warnings and audit annotations are attributed to
+// the webhook they came from, by its QualifiedName.
+func Aggregate(uid typesv1.UID, results []Result) *admissionv1.AdmissionResponse {
+	ret := CreateAllowResponse(uid)
+	var denials []string
+	for _, r := range results {
+		name, resp := r.Delegate.QualifiedName(), r.Response
+		for _, w := range resp.Warnings {
+			ret.Warnings = append(ret.Warnings, fmt.Sprintf("%s: %s", name, w))
+		}
+		for k, v := range resp.AuditAnnotations {
+			if ret.AuditAnnotations == nil {
+				ret.AuditAnnotations = make(map[string]string)
+			}
+			// Same as the kube-apiserver, keys are prefixed by the webhook,
+			// and its configuration since names are only unique in one.
+			ret.AuditAnnotations[name+"/"+k] = v
+		}
+		if resp.Allowed {
+			continue
+		}
+		msg := "no reason given"
+		if resp.Result != nil && resp.Result.Message != "" {
+			msg = resp.Result.Message
+		}
+		denials = append(denials, fmt.Sprintf("admission webhook %q denied the request: %s", name, msg))
+		if ret.Allowed {
+			// The first denial decides the code and reason.
+			ret.Allowed = false
+			ret.Result = &metav1.Status{Code: http.StatusForbidden}
+			if resp.Result != nil {
+				if resp.Result.Code != 0 {
+					ret.Result.Code = resp.Result.Code
+				}
+				ret.Result.Reason = resp.Result.Reason
+			}
+		}
+	}
+	if !ret.Allowed {
+		ret.Result.Message = strings.Join(denials, "; ")
+	}
+	return ret
+}
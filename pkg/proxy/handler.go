@@ -11,23 +11,169 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	v1 "k8s.io/api/admissionregistration/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	typesv1 "k8s.io/apimachinery/pkg/types"
 	"knative.dev/pkg/logging"
 )
 
+// TimeoutHeader can be set by the caller to the time it is willing to wait
+// for an answer, either as a duration ("1500ms") or in seconds ("1.5"). It
+// caps the timeout of the delegate.
+const TimeoutHeader = "X-Proxy-Timeout"
+
+// DefaultTimeout is how long we wait for a delegate when the webhook does not
+// specify TimeoutSeconds. Matches the kube-apiserver default.
+const DefaultTimeout = 10 * time.Second
+
 // Delegate normalizes the URL/Service endpoint as well as any necessary
 // CACerts.
 type Delegate struct {
-	Service    string
-	CACertPool *x509.CertPool
+	// Name of the webhook this Delegate is for.
+	Name string
+	// Configuration is the name of the webhook configuration the webhook
+	// belongs to.
+	Configuration string
+	Service       string
+	CACertPool    *x509.CertPool
+	// Timeout for a single call to the delegate.
+	Timeout time.Duration
+	// FailurePolicy says what to do when we fail to get an answer from the
+	// delegate. Empty is treated as Fail.
+	FailurePolicy v1.FailurePolicyType
+	// Index of the webhook in its configuration, which together with the
+	// Configuration decides the order the kube-apiserver calls webhooks in.
+	Index int
+	// Mutating is set for delegates of MutatingWebhooks, which are the only
+	// ones allowed to return patches.
+	Mutating bool
+	// ReinvocationPolicy of a MutatingWebhook, see Pipeline.
+	ReinvocationPolicy v1.ReinvocationPolicyType
+	// SideEffects of the webhook, delegates that may have side effects are
+	// not sent dry run requests.
+	SideEffects v1.SideEffectClass
+	// Rules of the webhook, used to skip requests that the kube-apiserver
+	// would not have sent to it.
+	Rules []v1.RuleWithOperations
+	// MatchPolicy says whether requests for resources equivalent to the ones
+	// in the Rules are sent to the webhook. Empty is treated as Equivalent.
+	MatchPolicy v1.MatchPolicyType
+	// namespaceSelector and objectSelector of the webhook, see SetSelectors.
+	namespaceSelector labels.Selector
+	objectSelector    labels.Selector
+	// matchConditions of the webhook, or the error compiling them, see
+	// SetMatchConditions.
+	matchConditions    []matchCondition
+	matchConditionsErr error
+	// Retry controls retries and the circuit breaker for the delegate.
+	Retry RetryOptions
+	// ReviewVersion is the AdmissionReview apiVersion the delegate speaks,
+	// see NegotiateReviewVersion. Empty means admission.k8s.io/v1.
+	ReviewVersion string
+	// Limits bounds the size of requests to and responses from the delegate.
+	Limits BodyLimits
+
+	// caBundle is the raw CABundle the CACertPool was built from, kept
+	// around so we can tell whether the transport needs rebuilding.
+	caBundle []byte
+	// transport is long lived and pooled so that we get keep-alives against
+	// the delegate instead of a TLS handshake per call.
+	transport *http.Transport
+	// breaker keeps track of whether the delegate is healthy.
+	breaker *breaker
+}
+
+// QualifiedName is <configuration>/<webhook>, which unlike the name of the
+// webhook alone tells apart webhooks of different configurations.
+func (d *Delegate) QualifiedName() string {
+	return d.Configuration + "/" + d.Name
+}
+
+// newTransport creates a pooled transport. Note it's fine if caCertPool is
+// nil because that just means we use container root CA.
+func newTransport(caCertPool *x509.CertPool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    caCertPool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return transport
+}
+
+// ReuseTransport makes d share the transport and circuit breaker of old if
+// both of them point to the same endpoint with the same CABundle, so that
+// connections already established to the delegate, and what we know about
+// its health, survive a reconcile. Returns true if the transport was reused,
+// false if the caller should Close old.
+func (d *Delegate) ReuseTransport(old *Delegate) bool {
+	if old == nil || old.transport == nil {
+		return false
+	}
+	if d.Service != old.Service || !bytes.Equal(d.caBundle, old.caBundle) {
+		return false
+	}
+	d.CACertPool = old.CACertPool
+	d.transport = old.transport
+	if old.breaker != nil {
+		d.breaker = old.breaker
+	}
+	return true
+}
+
+// connect creates the pooled transport of the Delegate, if it does not have
+// one yet.
+func (d *Delegate) connect() {
+	if d.transport == nil {
+		d.transport = newTransport(d.CACertPool)
+	}
+}
+
+// Close releases any idle connections held by the Delegate transport.
+func (d *Delegate) Close() {
+	if d == nil || d.transport == nil {
+		return
+	}
+	d.transport.CloseIdleConnections()
+}
+
+// client returns an http.Client for calling the delegate over its pooled
+// transport. Delegates that were never added to Delegates get a transport
+// of their own for every call. The client has no timeout of its own, calls
+// are bounded by the context, see doWithRetries.
+func (d *Delegate) client() *http.Client {
+	transport := d.transport
+	if transport == nil {
+		transport = newTransport(d.CACertPool)
+	}
+	return &http.Client{Transport: transport}
+}
+
+func (d *Delegate) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return d.Timeout
+}
+
+// WebhookTimeout converts the TimeoutSeconds of a webhook into a Duration,
+// defaulting it the same way the kube-apiserver does.
+func WebhookTimeout(timeoutSeconds *int32) time.Duration {
+	if timeoutSeconds == nil || *timeoutSeconds <= 0 {
+		return DefaultTimeout
+	}
+	return time.Duration(*timeoutSeconds) * time.Second
 }
 
 func CreateFailResponse(uid typesv1.UID, msg string) *admissionv1.AdmissionResponse {
@@ -41,6 +187,34 @@ func CreateFailResponse(uid typesv1.UID, msg string) *admissionv1.AdmissionRespo
 	}
 }
 
+// CreateNamespaceErrorResponse is returned when the namespace of the request
+// could not be found. With the Ignore policy the request is allowed, else it
+// fails. Either way the warnings say so.
+func CreateNamespaceErrorResponse(uid typesv1.UID, ns string, err error, policy v1.FailurePolicyType) *admissionv1.AdmissionResponse {
+	if policy == v1.Ignore {
+		ret := CreateAllowResponse(uid)
+		ret.Warnings = []string{fmt.Sprintf("Failed to get namespace %s, letting through: %s", ns, err)}
+		return ret
+	}
+	ret := CreateFailResponse(uid, fmt.Sprintf("Failed to get namespace %s %s", ns, err))
+	ret.Warnings = []string{fmt.Sprintf("Failed to get namespace %s, failing closed: %s", ns, err)}
+	return ret
+}
+
+// CreateTimeoutResponse is returned when the delegate did not respond within
+// its timeout, so callers can tell it apart from the delegate denying.
+func CreateTimeoutResponse(uid typesv1.UID, msg string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		UID:     uid,
+		Allowed: false,
+		Result: &metav1.Status{
+			Code:    http.StatusGatewayTimeout,
+			Reason:  metav1.StatusReasonTimeout,
+			Message: msg,
+		},
+	}
+}
+
 func CreateAllowResponse(uid typesv1.UID) *admissionv1.AdmissionResponse {
 	return &admissionv1.AdmissionResponse{
 		UID:     uid,
@@ -59,7 +233,11 @@ func WebhookClientConfigToURLAndCert(wcc v1.WebhookClientConfig) (*Delegate, err
 			return nil, fmt.Errorf("failed to parse certs from CABundle")
 		}
 		ret.CACertPool = caCertPool
+		ret.caBundle = wcc.CABundle
 	}
+	// The transport is only created once we know we can not reuse the one
+	// of the Delegate being replaced, see Delegates.Add.
+	ret.breaker = &breaker{}
 
 	if wcc.URL != nil {
 		ret.Service = *wcc.URL
@@ -93,54 +271,247 @@ func GetHookName(ctx context.Context, prefix string, uid typesv1.UID, req *http.
 	return strings.TrimPrefix(req.URL.Path, prefix), nil
 }
 
-// DoRequest will make the call to the real webhook.
+// WithCallerTimeout returns a context that is cancelled once the budget the
+// caller gave us in the TimeoutHeader runs out. If there is no header, or it
+// can not be parsed or is not positive, the context is returned as is.
+func WithCallerTimeout(ctx context.Context, req *http.Request) (context.Context, context.CancelFunc) {
+	if req == nil || req.Header.Get(TimeoutHeader) == "" {
+		return ctx, func() {}
+	}
+	val := req.Header.Get(TimeoutHeader)
+	timeout, err := parseTimeout(val)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Ignoring invalid %s header %q: %s", TimeoutHeader, val, err)
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// parseTimeout parses the value of the TimeoutHeader.
+func parseTimeout(val string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(val)
+	if err != nil {
+		secs, serr := strconv.ParseFloat(val, 64)
+		if serr != nil {
+			return 0, err
+		}
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive, got %s", timeout)
+	}
+	return timeout, nil
+}
+
+// DoRequest will make the call to the real webhook. Any error talking to
+// the delegate is turned into a response according to its FailurePolicy.
+// The call is abandoned if ctx is cancelled, which is not held against
+// the delegate.
+func DoRequest(ctx context.Context, delegate *Delegate, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if isDryRun(request) && !delegate.SupportsDryRun() {
+		return CreateDryRunUnsupportedResponse(request.UID, delegate.Name)
+	}
+	if !delegate.breakerAllow(ctx) {
+		return delegate.ErrorResponse(ctx, request.UID, ErrBreakerOpen)
+	}
+	resp, err := delegate.doWithRetries(ctx, request)
+	if err != nil && ctx.Err() != nil {
+		delegate.breakerCancel()
+		return delegate.cancelledResponse(ctx, request.UID, err)
+	}
+	delegate.breakerDone(ctx, err)
+	if err != nil {
+		record(ctx, delegate.QualifiedName(), failureCountM.M(1))
+		return delegate.ErrorResponse(ctx, request.UID, err)
+	}
+	return resp
+}
+
+// doWithRetries calls the delegate, retrying failures where the delegate
+// never got to process the request. All the attempts share the Timeout of
+// the delegate, the same budget the kube-apiserver would give it, and we stop
+// retrying once what is left of it is unlikely to cover another attempt.
+func (d *Delegate) doWithRetries(ctx context.Context, request *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err := doRequest(ctx, d, request)
+		if err == nil || attempt >= d.Retry.Attempts || !isRetryable(err) {
+			return resp, err
+		}
+		backoff := d.Retry.backoff(attempt)
+		if remaining := time.Until(deadline); backoff+time.Since(start) > remaining {
+			logging.FromContext(ctx).Warnf("Attempt %d calling delegate %s failed, not retrying with %s left: %s", attempt, d.Name, remaining, err)
+			return resp, err
+		}
+		logging.FromContext(ctx).Warnf("Attempt %d calling delegate %s failed, retrying in %s: %s", attempt, d.Name, backoff, err)
+		record(ctx, d.QualifiedName(), retryCountM.M(1))
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// breakerAllow checks if the circuit breaker lets a call to the delegate go
+// through.
+func (d *Delegate) breakerAllow(ctx context.Context) bool {
+	if d.breaker == nil {
+		return true
+	}
+	allowed, state, changed := d.breaker.allow(time.Now(), d.Retry.BreakerCooldown)
+	if changed {
+		d.breakerChanged(ctx, state)
+	}
+	return allowed
+}
+
+// breakerDone records the outcome of the call with the circuit breaker.
+func (d *Delegate) breakerDone(ctx context.Context, err error) {
+	if d.breaker == nil {
+		return
+	}
+	if state, changed := d.breaker.done(time.Now(), err == nil, d.Retry.BreakerThreshold); changed {
+		d.breakerChanged(ctx, state)
+	}
+}
+
+// breakerCancel lets the breaker know that the call was abandoned without
+// learning anything about the delegate.
+func (d *Delegate) breakerCancel() {
+	if d.breaker == nil {
+		return
+	}
+	d.breaker.cancel()
+}
+
+func (d *Delegate) breakerChanged(ctx context.Context, state breakerState) {
+	logging.FromContext(ctx).Warnf("Circuit breaker for delegate %s is now %s", d.Name, state)
+	record(ctx, d.QualifiedName(), breakerStateM.M(int64(state)))
+}
+
+// doRequest does the actual round trip to the delegate.
 // body is closed.
-func DoRequest(ctx context.Context, delegate Delegate, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
-	reviewRequest := &admissionv1.AdmissionReview{Request: request}
+func doRequest(ctx context.Context, delegate *Delegate, request *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+	version := delegate.reviewVersion()
+	typeMeta := metav1.TypeMeta{APIVersion: version, Kind: "AdmissionReview"}
+	var reviewRequest interface{} = &admissionv1.AdmissionReview{TypeMeta: typeMeta, Request: request}
+	if version == admissionV1beta1 {
+		reviewRequest = &admissionv1beta1.AdmissionReview{TypeMeta: typeMeta, Request: toV1beta1Request(request)}
+	}
 	body, err := json.Marshal(reviewRequest)
 	if err != nil {
-		return CreateFailResponse(request.UID, fmt.Sprintf("failed to marshal outgoing AdmissionReview: %s", err))
-	}
-	// Note it's fine if delegate.CACertPool is nil because that just means
-	// we use container root CA.
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:    delegate.CACertPool,
-				MinVersion: tls.VersionTLS12,
-			},
-		},
+		return nil, fmt.Errorf("failed to marshal outgoing AdmissionReview: %w", err)
 	}
-
-	proxyReq, err := http.NewRequest(http.MethodPost, delegate.Service, bytes.NewBuffer(body))
+	if max := delegate.Limits.MaxRequestBytes; max > 0 && int64(len(body)) > max {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d bytes", ErrRequestTooLarge, len(body), max)
+	}
+	client := delegate.client()
+	proxyReq, err := http.NewRequestWithContext(ctx, http.MethodPost, delegate.Service, bytes.NewBuffer(body))
 	if err != nil {
-		logging.FromContext(ctx).Errorf("Failed to create request: %s", err)
-		return CreateFailResponse(request.UID, fmt.Sprintf("Failed to post %s", err))
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	proxyReq.Header.Set("Content-Type", "application/json")
 	proxyResp, err := client.Do(proxyReq)
 	if err != nil {
-		logging.FromContext(ctx).Errorf("Failed to post: %s", err)
-		return CreateFailResponse(request.UID, fmt.Sprintf("Failed to post %s", err))
+		return nil, fmt.Errorf("failed to post: %w", err)
 	}
 	if proxyResp == nil {
-		logging.FromContext(ctx).Error("Nil response from proxy")
-		return CreateFailResponse(request.UID, "Nil response from proxy")
+		return nil, errors.New("nil response from proxy")
 	}
 	defer proxyResp.Body.Close()
+	if proxyResp.StatusCode == http.StatusServiceUnavailable {
+		return nil, &retryableError{err: fmt.Errorf("%w: %s", ErrBadStatus, proxyResp.Status)}
+	}
+	if err := validateStatus(proxyResp.StatusCode, proxyResp.Status); err != nil {
+		return nil, err
+	}
 
-	b, err := io.ReadAll(proxyResp.Body)
+	var respBody io.Reader = proxyResp.Body
+	if max := delegate.Limits.MaxResponseBytes; max > 0 {
+		respBody = &limitedReader{r: proxyResp.Body, n: max}
+	}
+	ret, err := decodeReview(respBody, version)
 	if err != nil {
-		logging.FromContext(ctx).Errorf("Failed to read body of response: %s", err)
-		return CreateFailResponse(request.UID, fmt.Sprintf("Failed to read body of response: %s", err))
+		if errors.Is(err, ErrResponseTooLarge) {
+			return nil, fmt.Errorf("%w: limit is %d bytes", ErrResponseTooLarge, delegate.Limits.MaxResponseBytes)
+		}
+		return nil, fmt.Errorf("failed to decode body of response: %w", err)
+	}
+	logging.FromContext(ctx).Debugf("Got back: %+v", ret.Response)
+	if err := delegate.validateReview(request, ret, version); err != nil {
+		return nil, err
 	}
+	return ret.Response, nil
+}
 
-	ret := &admissionv1.AdmissionReview{}
-	err = json.Unmarshal(b, ret)
-	if err != nil {
-		logging.FromContext(ctx).Errorf("Failed to unmarshal response: %s\n%s", err, b)
-		return CreateFailResponse(request.UID, fmt.Sprintf("Failed to unmarshal body of response: %s", err))
+// decodeReview decodes the AdmissionReview of the given version from r, and
+// converts it to v1 if need be.
+func decodeReview(r io.Reader, version string) (*admissionv1.AdmissionReview, error) {
+	if version == admissionV1beta1 {
+		review := &admissionv1beta1.AdmissionReview{}
+		if err := json.NewDecoder(r).Decode(review); err != nil {
+			return nil, err
+		}
+		return fromV1beta1Review(review), nil
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(r).Decode(review); err != nil {
+		return nil, err
+	}
+	return review, nil
+}
+
+func (d *Delegate) reviewVersion() string {
+	if d.ReviewVersion == "" {
+		return admissionV1
+	}
+	return d.ReviewVersion
+}
+
+// ErrorResponse applies the apiserver semantics of the FailurePolicy to an
+// error calling the delegate. With Ignore the request is allowed with a
+// warning, otherwise it is denied.
+func (d *Delegate) ErrorResponse(ctx context.Context, uid typesv1.UID, err error) *admissionv1.AdmissionResponse {
+	logging.FromContext(ctx).Errorf("Failed calling delegate %s at %s: %s", d.Name, d.Service, err)
+	return d.policyResponse(uid, err)
+}
+
+// cancelledResponse is returned when the caller cancelled the request or
+// ran out of its time budget before the delegate answered.
+func (d *Delegate) cancelledResponse(ctx context.Context, uid typesv1.UID, err error) *admissionv1.AdmissionResponse {
+	logging.FromContext(ctx).Infof("Call to delegate %s cancelled by the caller: %s", d.Name, err)
+	record(ctx, d.QualifiedName(), cancelledCountM.M(1))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// The caller budget ran out, which to the caller is a timeout.
+		return d.policyResponse(uid, fmt.Errorf("caller deadline exceeded: %w", ctx.Err()))
+	}
+	return CreateFailResponse(uid, fmt.Sprintf("Call to webhook %q cancelled: %s", d.Name, ctx.Err()))
+}
+
+// policyResponse creates the response for a failed call according to the
+// FailurePolicy.
+func (d *Delegate) policyResponse(uid typesv1.UID, err error) *admissionv1.AdmissionResponse {
+	if d.FailurePolicy == v1.Ignore {
+		resp := CreateAllowResponse(uid)
+		resp.Warnings = []string{fmt.Sprintf("failed calling webhook %q: %s; allowed because failurePolicy is Ignore", d.Name, err)}
+		return resp
+	}
+	if isTimeout(err) {
+		return CreateTimeoutResponse(uid, fmt.Sprintf("Timed out after %s waiting for %s: %s", d.timeout(), d.Service, err))
+	}
+	return CreateFailResponse(uid, fmt.Sprintf("Failed calling webhook %q: %s", d.Name, err))
+}
+
+// isTimeout checks if the error is because the delegate call took longer
+// than allowed.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
 	}
-	logging.FromContext(ctx).Errorf("Got back: %s", b)
-	return ret.Response
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
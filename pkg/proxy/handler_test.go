@@ -0,0 +1,1165 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newDelegateServer returns a server that responds with the given
+// AdmissionResponse after the given delay.
+func newDelegateServer(t *testing.T, delay time.Duration, resp *admissionv1.AdmissionResponse) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := &admissionv1.AdmissionReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			t.Errorf("Failed to decode request: %s", err)
+		}
+		time.Sleep(delay)
+		out := *resp
+		out.UID = review.Request.UID
+		review.Response = &out
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+}
+
+func TestDoRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		delay         time.Duration
+		down          bool
+		failurePolicy v1.FailurePolicyType
+		wantAllowed   bool
+		wantCode      int32
+		wantWarning   bool
+	}{{
+		name:        "allowed",
+		wantAllowed: true,
+	}, {
+		name:     "timeout, fail",
+		delay:    200 * time.Millisecond,
+		wantCode: http.StatusGatewayTimeout,
+	}, {
+		name:          "timeout, ignore",
+		delay:         200 * time.Millisecond,
+		failurePolicy: v1.Ignore,
+		wantAllowed:   true,
+		wantWarning:   true,
+	}, {
+		name:          "unreachable, fail",
+		down:          true,
+		failurePolicy: v1.Fail,
+		wantCode:      http.StatusInternalServerError,
+	}, {
+		name:          "unreachable, ignore",
+		down:          true,
+		failurePolicy: v1.Ignore,
+		wantAllowed:   true,
+		wantWarning:   true,
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newDelegateServer(t, tc.delay, &admissionv1.AdmissionResponse{Allowed: true})
+			defer srv.Close()
+			wcc := v1.WebhookClientConfig{URL: &srv.URL}
+			delegate, err := WebhookClientConfigToURLAndCert(wcc)
+			if err != nil {
+				t.Fatalf("Failed to create delegate: %s", err)
+			}
+			defer delegate.Close()
+			delegate.Name = "test.webhook"
+			delegate.Timeout = 50 * time.Millisecond
+			delegate.FailurePolicy = tc.failurePolicy
+			if tc.down {
+				srv.Close()
+			}
+			got := DoRequest(context.Background(), delegate, &admissionv1.AdmissionRequest{UID: "test-uid"})
+			if got.Allowed != tc.wantAllowed {
+				t.Errorf("Allowed mismatch want %v got %v: %+v", tc.wantAllowed, got.Allowed, got.Result)
+			}
+			if got.UID != "test-uid" {
+				t.Errorf("UID mismatch got %s", got.UID)
+			}
+			if tc.wantCode != 0 && (got.Result == nil || got.Result.Code != tc.wantCode) {
+				t.Errorf("Wanted code %d got %+v", tc.wantCode, got.Result)
+			}
+			if tc.wantWarning != (len(got.Warnings) > 0) {
+				t.Errorf("Wanted warning %v got %v", tc.wantWarning, got.Warnings)
+			}
+		})
+	}
+}
+
+func TestDoRequestRetriesAndBreaker(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	delegate.Name = "test.webhook"
+	delegate.Retry = RetryOptions{
+		Attempts:         3,
+		Backoff:          time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Hour,
+	}
+	request := &admissionv1.AdmissionRequest{UID: "test-uid"}
+	for i := 0; i < 2; i++ {
+		if got := DoRequest(context.Background(), delegate, request); got.Allowed {
+			t.Errorf("Call %d allowed, wanted denied", i)
+		}
+	}
+	if calls != 6 {
+		t.Errorf("Wanted 6 calls with retries, got %d", calls)
+	}
+	// Breaker is now open, so we fail fast without calling the delegate.
+	got := DoRequest(context.Background(), delegate, request)
+	if got.Allowed || got.Result == nil || !strings.Contains(got.Result.Message, ErrBreakerOpen.Error()) {
+		t.Errorf("Wanted breaker open failure, got %+v", got)
+	}
+	if calls != 6 {
+		t.Errorf("Breaker open, but delegate got called: %d", calls)
+	}
+	// With Ignore we fall back to allowing.
+	delegate.FailurePolicy = v1.Ignore
+	if got := DoRequest(context.Background(), delegate, request); !got.Allowed || len(got.Warnings) == 0 {
+		t.Errorf("Wanted allowed with warning, got %+v", got)
+	}
+}
+
+func TestDoRequestRetriesWithinTimeout(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(40 * time.Millisecond)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	delegate.Name = "test.webhook"
+	delegate.Timeout = 100 * time.Millisecond
+	delegate.Retry = RetryOptions{Attempts: 10, Backoff: time.Millisecond}
+	start := time.Now()
+	if got := DoRequest(context.Background(), delegate, &admissionv1.AdmissionRequest{UID: "test-uid"}); got.Allowed {
+		t.Errorf("Wanted denied, got %+v", got)
+	}
+	if took := time.Since(start); took > 2*delegate.Timeout {
+		t.Errorf("Retries took %s, more than the timeout of %s", took, delegate.Timeout)
+	}
+	if got := atomic.LoadInt32(&calls); got < 2 || got > 3 {
+		t.Errorf("Wanted the attempts cut short by the timeout, got %d calls", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	o := RetryOptions{Backoff: time.Second}
+	for _, attempt := range []int{1, 10, 64, 1000} {
+		if got := o.backoff(attempt); got <= 0 || got > maxBackoff {
+			t.Errorf("Attempt %d: wanted a backoff up to %s, got %s", attempt, maxBackoff, got)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{}
+	now := time.Now()
+	cooldown := time.Minute
+	if state, changed := b.done(now, false, 2); changed || state != breakerClosed {
+		t.Errorf("One failure should not open, got %s", state)
+	}
+	if state, changed := b.done(now, false, 2); !changed || state != breakerOpen {
+		t.Errorf("Two failures should open, got %s", state)
+	}
+	if allowed, _, _ := b.allow(now.Add(time.Second), cooldown); allowed {
+		t.Error("Open breaker allowed a call before cooldown")
+	}
+	if allowed, state, _ := b.allow(now.Add(2*cooldown), cooldown); !allowed || state != breakerHalfOpen {
+		t.Errorf("Wanted a half-open probe after cooldown, got %v %s", allowed, state)
+	}
+	if allowed, _, _ := b.allow(now.Add(2*cooldown), cooldown); allowed {
+		t.Error("Only one probe should be let through when half-open")
+	}
+	if state, _ := b.done(now.Add(2*cooldown), false, 2); state != breakerOpen {
+		t.Errorf("Failed probe should reopen, got %s", state)
+	}
+	if allowed, _, _ := b.allow(now.Add(4*cooldown), cooldown); !allowed {
+		t.Error("Wanted a probe after second cooldown")
+	}
+	if state, _ := b.done(now.Add(4*cooldown), true, 2); state != breakerClosed {
+		t.Errorf("Successful probe should close, got %s", state)
+	}
+}
+
+func TestDoRequestCallerTimeout(t *testing.T) {
+	srv := newDelegateServer(t, 200*time.Millisecond, &admissionv1.AdmissionResponse{Allowed: true})
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	delegate.Name = "test.webhook"
+	delegate.Retry = RetryOptions{BreakerThreshold: 1, BreakerCooldown: time.Hour}
+
+	for _, val := range []string{"50ms", "0.05"} {
+		req := httptest.NewRequest(http.MethodPost, "/admit/test.webhook", nil)
+		req.Header.Set(TimeoutHeader, val)
+		ctx, cancel := WithCallerTimeout(context.Background(), req)
+		got := DoRequest(ctx, delegate, &admissionv1.AdmissionRequest{UID: "test-uid"})
+		cancel()
+		if got.Allowed || got.Result == nil || got.Result.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: wanted a timeout, got %+v", val, got)
+		}
+	}
+	// Caller giving up is not the fault of the delegate, so the breaker
+	// must not have opened.
+	if got := DoRequest(context.Background(), delegate, &admissionv1.AdmissionRequest{UID: "test-uid"}); !got.Allowed {
+		t.Errorf("Wanted allowed, got %+v", got.Result)
+	}
+}
+
+func TestWithCallerTimeoutInvalid(t *testing.T) {
+	for _, val := range []string{"0", "0s", "-1", "-5s", "soon"} {
+		req := httptest.NewRequest(http.MethodPost, "/admit/test.webhook", nil)
+		req.Header.Set(TimeoutHeader, val)
+		ctx, cancel := WithCallerTimeout(context.Background(), req)
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("%s: wanted the header ignored, got a deadline", val)
+		}
+		cancel()
+	}
+}
+
+func TestValidateReview(t *testing.T) {
+	jsonPatch := admissionv1.PatchTypeJSONPatch
+	otherPatch := admissionv1.PatchType("MergePatch")
+	typeMeta := metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+	tests := []struct {
+		name     string
+		mutating bool
+		review   *admissionv1.AdmissionReview
+		want     error
+	}{{
+		name:   "valid",
+		review: &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "uid"}},
+	}, {
+		name:   "missing type meta",
+		review: &admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{UID: "uid"}},
+		want:   ErrBadTypeMeta,
+	}, {
+		name:   "no response",
+		review: &admissionv1.AdmissionReview{TypeMeta: typeMeta},
+		want:   ErrNoResponse,
+	}, {
+		name:   "wrong uid",
+		review: &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "other"}},
+		want:   ErrUIDMismatch,
+	}, {
+		name:   "patch from validating",
+		review: &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "uid", Patch: []byte("[]"), PatchType: &jsonPatch}},
+		want:   ErrUnexpectedPatch,
+	}, {
+		name:   "patch type without patch from validating",
+		review: &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "uid", PatchType: &jsonPatch}},
+	}, {
+		name:     "patch from mutating",
+		mutating: true,
+		review:   &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "uid", Patch: []byte("[]"), PatchType: &jsonPatch}},
+	}, {
+		name:     "patch without type",
+		mutating: true,
+		review:   &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "uid", Patch: []byte("[]")}},
+		want:     ErrBadPatchType,
+	}, {
+		name:     "patch with wrong type",
+		mutating: true,
+		review:   &admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: &admissionv1.AdmissionResponse{UID: "uid", Patch: []byte("[]"), PatchType: &otherPatch}},
+		want:     ErrBadPatchType,
+	}}
+	for _, tc := range tests {
+		d := &Delegate{Mutating: tc.mutating}
+		err := d.validateReview(&admissionv1.AdmissionRequest{UID: "uid"}, tc.review, "admission.k8s.io/v1")
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%q wanted %v got %v", tc.name, tc.want, err)
+		}
+	}
+
+	// Legacy delegates are only held to having a response.
+	d := &Delegate{Mutating: true}
+	legacy := &admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{Allowed: true, Patch: []byte("[]")}}
+	if err := d.validateReview(&admissionv1.AdmissionRequest{UID: "uid"}, legacy, "admission.k8s.io/v1beta1"); err != nil {
+		t.Fatalf("Wanted v1beta1 review accepted, got %v", err)
+	}
+	if legacy.Response.UID != "uid" {
+		t.Errorf("Wanted the UID of the request, got %q", legacy.Response.UID)
+	}
+	if legacy.Response.PatchType == nil || *legacy.Response.PatchType != jsonPatch {
+		t.Errorf("Wanted patchType defaulted to %s, got %v", jsonPatch, legacy.Response.PatchType)
+	}
+	if err := d.validateReview(&admissionv1.AdmissionRequest{UID: "uid"}, &admissionv1.AdmissionReview{}, "admission.k8s.io/v1beta1"); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("Wanted %v, got %v", ErrNoResponse, err)
+	}
+}
+
+func TestDoRequestBadStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("<html>bad gateway</html>"))
+	}))
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	got := DoRequest(context.Background(), delegate, &admissionv1.AdmissionRequest{UID: "test-uid"})
+	if got.Allowed || got.Result == nil || !strings.Contains(got.Result.Message, ErrBadStatus.Error()) {
+		t.Errorf("Wanted bad status failure, got %+v", got)
+	}
+}
+
+func TestDoRequestBodyLimits(t *testing.T) {
+	srv := newDelegateServer(t, 0, &admissionv1.AdmissionResponse{Allowed: true, Warnings: []string{strings.Repeat("x", 1024)}})
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	request := &admissionv1.AdmissionRequest{UID: "test-uid"}
+
+	delegate.Limits = BodyLimits{MaxRequestBytes: 4096, MaxResponseBytes: 4096}
+	if got := DoRequest(context.Background(), delegate, request); !got.Allowed {
+		t.Errorf("Wanted allowed under the limits, got %+v", got.Result)
+	}
+	delegate.Limits = BodyLimits{MaxRequestBytes: 4096, MaxResponseBytes: 512}
+	if got := DoRequest(context.Background(), delegate, request); got.Allowed || !strings.Contains(got.Result.Message, ErrResponseTooLarge.Error()) {
+		t.Errorf("Wanted response too large, got %+v", got)
+	}
+	delegate.Limits = BodyLimits{MaxRequestBytes: 10, MaxResponseBytes: 4096}
+	if got := DoRequest(context.Background(), delegate, request); got.Allowed || !strings.Contains(got.Result.Message, ErrRequestTooLarge.Error()) {
+		t.Errorf("Wanted request too large, got %+v", got)
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	handler := LimitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}), 10)
+	tests := []struct {
+		name     string
+		body     io.Reader
+		wantCode int
+	}{{
+		name:     "under the limit",
+		body:     strings.NewReader("small"),
+		wantCode: http.StatusOK,
+	}, {
+		name:     "over the limit",
+		body:     strings.NewReader("too large for the limit"),
+		wantCode: http.StatusRequestEntityTooLarge,
+	}, {
+		// No Content-Length, so the limit is only hit while reading.
+		name:     "over the limit, unknown length",
+		body:     io.MultiReader(strings.NewReader("too large for the limit")),
+		wantCode: http.StatusBadRequest,
+	}}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admit/test.webhook", tc.body))
+		if w.Code != tc.wantCode {
+			t.Errorf("%q wanted code %d got %d: %s", tc.name, tc.wantCode, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDoRequestV1beta1(t *testing.T) {
+	var gotVersion string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := &admissionv1beta1.AdmissionReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			t.Errorf("Failed to decode request: %s", err)
+		}
+		gotVersion = review.APIVersion
+		patchType := admissionv1beta1.PatchTypeJSONPatch
+		review.Response = &admissionv1beta1.AdmissionResponse{UID: review.Request.UID, Allowed: true, Patch: []byte("[]"), PatchType: &patchType}
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	delegate.Mutating = true
+	if delegate.ReviewVersion, err = NegotiateReviewVersion([]string{"v1beta2", "v1beta1"}); err != nil {
+		t.Fatalf("Failed to negotiate: %s", err)
+	}
+	got := DoRequest(context.Background(), delegate, &admissionv1.AdmissionRequest{UID: "test-uid"})
+	if !got.Allowed || got.PatchType == nil || *got.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Errorf("Wanted allowed with a JSONPatch, got %+v", got)
+	}
+	if gotVersion != "admission.k8s.io/v1beta1" {
+		t.Errorf("Wanted delegate to get v1beta1, got %q", gotVersion)
+	}
+	if _, err := NegotiateReviewVersion([]string{"v2"}); err == nil {
+		t.Error("Wanted error for unsupported versions")
+	}
+}
+
+func TestDelegatesLookup(t *testing.T) {
+	ds := NewDelegates()
+	ds.Add(&Delegate{Configuration: "config-a", Name: "shared.webhook", Service: "https://a"})
+	ds.Add(&Delegate{Configuration: "config-b", Name: "shared.webhook", Service: "https://b"})
+	ds.Add(&Delegate{Configuration: "config-a", Name: "unique.webhook", Service: "https://unique"})
+	tests := []struct {
+		path        string
+		wantService string
+		wantErr     error
+	}{{
+		path:        "unique.webhook",
+		wantService: "https://unique",
+	}, {
+		path:        "config-a/unique.webhook",
+		wantService: "https://unique",
+	}, {
+		path:        "config-b/shared.webhook",
+		wantService: "https://b",
+	}, {
+		path:    "shared.webhook",
+		wantErr: ErrAmbiguousDelegate,
+	}, {
+		path:    "config-b/unique.webhook",
+		wantErr: ErrNoDelegate,
+	}, {
+		path:    "missing.webhook",
+		wantErr: ErrNoDelegate,
+	}}
+	for _, tc := range tests {
+		got, err := ds.Lookup(tc.path)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%q wanted error %v got %v", tc.path, tc.wantErr, err)
+		}
+		if err == nil && got.Service != tc.wantService {
+			t.Errorf("%q wanted %s got %s", tc.path, tc.wantService, got.Service)
+		}
+	}
+}
+
+func TestDelegatesAddTransport(t *testing.T) {
+	ds := NewDelegates()
+	newDelegate := func(url string) *Delegate {
+		t.Helper()
+		d, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &url})
+		if err != nil {
+			t.Fatalf("Failed to create delegate: %s", err)
+		}
+		d.Configuration = "config"
+		d.Name = "test.webhook"
+		return d
+	}
+	first := newDelegate("https://one")
+	if first.transport != nil {
+		t.Error("Wanted no transport before the delegate is added")
+	}
+	ds.Add(first)
+	if first.transport == nil {
+		t.Fatal("Wanted a transport once the delegate is added")
+	}
+	same := newDelegate("https://one")
+	ds.Add(same)
+	if same.transport != first.transport || same.breaker != first.breaker {
+		t.Error("Wanted the transport and breaker of the same endpoint reused")
+	}
+	other := newDelegate("https://two")
+	ds.Add(other)
+	if other.transport == nil || other.transport == first.transport {
+		t.Error("Wanted a new transport for a new endpoint")
+	}
+}
+
+func TestDelegatesPrune(t *testing.T) {
+	ds := NewDelegates()
+	ds.Add(&Delegate{Configuration: "config-a", Name: "one.webhook", Service: "https://one"})
+	ds.Add(&Delegate{Configuration: "config-a", Name: "two.webhook", Service: "https://two"})
+	ds.Add(&Delegate{Configuration: "config-b", Name: "three.webhook", Service: "https://three"})
+
+	if removed := ds.Prune("config-a", "one.webhook"); len(removed) != 1 || removed[0] != "two.webhook" {
+		t.Errorf("Wanted two.webhook removed, got %v", removed)
+	}
+	if _, err := ds.Lookup("config-a/two.webhook"); !errors.Is(err, ErrNoDelegate) {
+		t.Errorf("Wanted two.webhook gone, got %v", err)
+	}
+	if _, err := ds.Lookup("config-a/one.webhook"); err != nil {
+		t.Errorf("Wanted one.webhook kept, got %v", err)
+	}
+	if removed := ds.Prune("config-b"); len(removed) != 1 {
+		t.Errorf("Wanted config-b removed, got %v", removed)
+	}
+	if _, err := ds.Lookup("three.webhook"); !errors.Is(err, ErrNoDelegate) {
+		t.Errorf("Wanted three.webhook gone, got %v", err)
+	}
+	if removed := ds.Prune("missing"); len(removed) != 0 {
+		t.Errorf("Wanted nothing removed, got %v", removed)
+	}
+}
+
+func TestMatchesRules(t *testing.T) {
+	namespaced := v1.NamespacedScope
+	cluster := v1.ClusterScope
+	podRule := v1.RuleWithOperations{
+		Operations: []v1.OperationType{v1.Create, v1.Update},
+		Rule: v1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"pods", "pods/ephemeralcontainers"},
+			Scope:       &namespaced,
+		},
+	}
+	allRule := v1.RuleWithOperations{
+		Operations: []v1.OperationType{v1.OperationAll},
+		Rule: v1.Rule{
+			APIGroups:   []string{"*"},
+			APIVersions: []string{"*"},
+			Resources:   []string{"*"},
+			Scope:       &cluster,
+		},
+	}
+	pods := metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	namespaces := metav1.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	deployments := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	tests := []struct {
+		name    string
+		rules   []v1.RuleWithOperations
+		request admissionv1.AdmissionRequest
+		want    bool
+	}{{
+		name:    "no rules",
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Create, Resource: pods, Namespace: "ns"},
+	}, {
+		name:    "pod create",
+		rules:   []v1.RuleWithOperations{podRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Create, Resource: pods, Namespace: "ns"},
+		want:    true,
+	}, {
+		name:    "pod delete",
+		rules:   []v1.RuleWithOperations{podRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Delete, Resource: pods, Namespace: "ns"},
+	}, {
+		name:    "pod subresource",
+		rules:   []v1.RuleWithOperations{podRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Update, Resource: pods, SubResource: "ephemeralcontainers", Namespace: "ns"},
+		want:    true,
+	}, {
+		name:    "pod status not matched",
+		rules:   []v1.RuleWithOperations{podRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Update, Resource: pods, SubResource: "status", Namespace: "ns"},
+	}, {
+		name:    "deployment",
+		rules:   []v1.RuleWithOperations{podRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Create, Resource: deployments, Namespace: "ns"},
+	}, {
+		name:    "namespaced resource with cluster scope",
+		rules:   []v1.RuleWithOperations{allRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Create, Resource: deployments, Namespace: "ns"},
+	}, {
+		name:    "namespace with cluster scope",
+		rules:   []v1.RuleWithOperations{allRule},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Create, Resource: namespaces, Namespace: "ns"},
+		want:    true,
+	}, {
+		name: "namespace subresource with cluster scope",
+		rules: []v1.RuleWithOperations{{
+			Operations: []v1.OperationType{v1.OperationAll},
+			Rule:       v1.Rule{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"namespaces/finalize"}, Scope: &cluster},
+		}},
+		request: admissionv1.AdmissionRequest{Operation: admissionv1.Update, Resource: namespaces, SubResource: "finalize", Namespace: "ns"},
+		want:    true,
+	}}
+	for _, tc := range tests {
+		d := &Delegate{Rules: tc.rules}
+		if got := d.MatchesRules(&tc.request); got != tc.want {
+			t.Errorf("%q wanted %v got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestMatchesSelectors(t *testing.T) {
+	pods := metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	namespaces := metav1.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	nodes := metav1.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}}
+	object := func(l string) runtime.RawExtension {
+		return runtime.RawExtension{Raw: []byte(`{"metadata":{"labels":{"team":"` + l + `"}}}`)}
+	}
+	nsWithTeam := func(l string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Labels: map[string]string{"team": l}}}
+	}
+	tests := []struct {
+		name       string
+		nsSelector *metav1.LabelSelector
+		obSelector *metav1.LabelSelector
+		request    admissionv1.AdmissionRequest
+		ns         *corev1.Namespace
+		want       string
+	}{{
+		name:    "no selectors",
+		request: admissionv1.AdmissionRequest{Resource: pods, Namespace: "ns"},
+		ns:      nsWithTeam("b"),
+	}, {
+		name:       "namespace matches",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: pods, Namespace: "ns"},
+		ns:         nsWithTeam("a"),
+	}, {
+		name:       "namespace does not match",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: pods, Namespace: "ns"},
+		ns:         nsWithTeam("b"),
+		want:       "namespaceSelector",
+	}, {
+		name:       "cluster scoped ignores namespace selector",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: nodes},
+	}, {
+		name:       "namespace object uses its own labels",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: namespaces, Namespace: "ns", Object: object("a")},
+	}, {
+		name:       "namespace update uses the new labels",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: namespaces, Namespace: "ns", Operation: admissionv1.Update, Object: object("b"), OldObject: object("a")},
+		want:       "namespaceSelector",
+	}, {
+		name:       "namespace delete uses the old labels",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: namespaces, Namespace: "ns", Operation: admissionv1.Delete, OldObject: object("a")},
+	}, {
+		name:       "namespace subresource uses the namespace labels",
+		nsSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: namespaces, SubResource: "status", Namespace: "ns", Operation: admissionv1.Update, Object: object("b")},
+		want:       "namespaceSelector",
+	}, {
+		name:       "object matches",
+		obSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: pods, Namespace: "ns", Object: object("a")},
+	}, {
+		name:       "old object matches",
+		obSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: pods, Namespace: "ns", Object: object("b"), OldObject: object("a")},
+	}, {
+		name:       "object does not match",
+		obSelector: selector,
+		request:    admissionv1.AdmissionRequest{Resource: pods, Namespace: "ns", Object: object("b")},
+		want:       "objectSelector",
+	}}
+	allRules := []v1.RuleWithOperations{{
+		Operations: []v1.OperationType{v1.OperationAll},
+		Rule:       v1.Rule{APIGroups: []string{"*"}, APIVersions: []string{"*"}, Resources: []string{"*", "*/*"}},
+	}}
+	for _, tc := range tests {
+		d := &Delegate{Rules: allRules}
+		if err := d.SetSelectors(tc.nsSelector, tc.obSelector); err != nil {
+			t.Fatalf("%q failed to set selectors: %s", tc.name, err)
+		}
+		if tc.request.Operation == "" {
+			tc.request.Operation = admissionv1.Create
+		}
+		got, err := d.Matches(&tc.request, tc.ns)
+		if err != nil {
+			t.Errorf("%q failed: %s", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q wanted %q got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestMatchConditions(t *testing.T) {
+	d := &Delegate{}
+	err := d.SetMatchConditions([]v1.MatchCondition{{
+		Name:       "bad",
+		Expression: "object.metadata.name ==",
+	}, {
+		Name:       "not-bool",
+		Expression: "'string'",
+	}})
+	if err == nil || !strings.Contains(err.Error(), `"bad"`) || !strings.Contains(err.Error(), `"not-bool"`) {
+		t.Errorf("Wanted compile errors for both conditions, got %v", err)
+	}
+	if _, _, err := d.MatchesConditions(&admissionv1.AdmissionRequest{}); err == nil {
+		t.Error("Wanted requests to fail while the conditions are invalid")
+	}
+
+	if err := d.SetMatchConditions([]v1.MatchCondition{{
+		Name:       "not-kube-system",
+		Expression: "request.namespace != 'kube-system'",
+	}, {
+		Name:       "labeled",
+		Expression: "oldObject == null || has(object.metadata.labels) && 'team' in object.metadata.labels",
+	}}); err != nil {
+		t.Fatalf("Failed to compile: %s", err)
+	}
+	labeled := runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"foo","labels":{"team":"a"}}}`)}
+	unlabeled := runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"foo"}}`)}
+	tests := []struct {
+		name    string
+		request admissionv1.AdmissionRequest
+		want    string
+	}{{
+		name:    "create",
+		request: admissionv1.AdmissionRequest{Namespace: "default", Object: unlabeled},
+	}, {
+		name:    "kube-system",
+		request: admissionv1.AdmissionRequest{Namespace: "kube-system", Object: labeled},
+		want:    "not-kube-system",
+	}, {
+		name:    "update labeled",
+		request: admissionv1.AdmissionRequest{Namespace: "default", Object: labeled, OldObject: unlabeled},
+	}, {
+		name:    "update unlabeled",
+		request: admissionv1.AdmissionRequest{Namespace: "default", Object: unlabeled, OldObject: unlabeled},
+		want:    "labeled",
+	}}
+	for _, tc := range tests {
+		matched, got, err := d.MatchesConditions(&tc.request)
+		if err != nil {
+			t.Errorf("%q failed: %s", tc.name, err)
+		}
+		if matched != (tc.want == "") || got != tc.want {
+			t.Errorf("%q wanted %q got %v %q", tc.name, tc.want, matched, got)
+		}
+	}
+}
+
+func TestMatchEquivalent(t *testing.T) {
+	fakeDiscovery := &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{}}
+	fakeDiscovery.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment"}, {Name: "deployments/scale", Kind: "Scale"}},
+	}, {
+		GroupVersion: "extensions/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment"}},
+	}, {
+		GroupVersion: "autoscaling/v1",
+		APIResources: []metav1.APIResource{{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler"}},
+	}, {
+		GroupVersion: "autoscaling/v2",
+		APIResources: []metav1.APIResource{{Name: "horizontalpodautoscalers", Kind: "HorizontalPodAutoscaler"}},
+	}}
+	equivalents := NewEquivalentResources(fakeDiscovery)
+	d := &Delegate{
+		Name: "test.webhook",
+		Rules: []v1.RuleWithOperations{{
+			Operations: []v1.OperationType{v1.Create},
+			Rule:       v1.Rule{APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"deployments"}},
+		}},
+	}
+	request := &admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Group: "extensions", Version: "v1beta1", Kind: "Deployment"},
+		Resource:  metav1.GroupVersionResource{Group: "extensions", Version: "v1beta1", Resource: "deployments"},
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: []byte(`{"apiVersion":"extensions/v1beta1","kind":"Deployment","metadata":{"name":"foo"},"spec":{"replicas":2}}`)},
+	}
+
+	// Deployments moved to apps without changing their schema.
+	got, err := d.MatchEquivalent(context.Background(), request, equivalents)
+	if err != nil {
+		t.Fatalf("Failed to match: %s", err)
+	}
+	if got.Resource.Group != "apps" || got.Kind.Version != "v1" {
+		t.Errorf("Wanted apps/v1 deployments, got %v %v", got.Resource, got.Kind)
+	}
+	if got.RequestResource == nil || got.RequestResource.Group != "extensions" || got.RequestKind == nil || got.RequestKind.Group != "extensions" {
+		t.Errorf("Wanted original resource in RequestResource/RequestKind, got %v %v", got.RequestResource, got.RequestKind)
+	}
+	if !d.MatchesRules(got) {
+		t.Error("Converted request does not match the rules")
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(got.Object.Raw, &object); err != nil {
+		t.Fatalf("Failed to decode converted object: %s", err)
+	}
+	if object["apiVersion"] != "apps/v1" || object["kind"] != "Deployment" {
+		t.Errorf("Wanted apps/v1 Deployment, got %v", object)
+	}
+	if spec, _ := object["spec"].(map[string]interface{}); spec["replicas"] != float64(2) {
+		t.Errorf("Wanted the spec to be kept, got %v", object)
+	}
+
+	// Without an object there is nothing to convert.
+	noObject := request.DeepCopy()
+	noObject.Object = runtime.RawExtension{}
+	if got, err := d.MatchEquivalent(context.Background(), noObject, equivalents); err != nil || got.Resource.Group != "apps" {
+		t.Errorf("Wanted apps/v1 deployments, got %v %v", got, err)
+	}
+
+	// The versions of HorizontalPodAutoscalers differ in their fields, so
+	// requests for them are not converted, and do not match.
+	hpa := &Delegate{
+		Name: "hpa.webhook",
+		Rules: []v1.RuleWithOperations{{
+			Operations: []v1.OperationType{v1.Create},
+			Rule:       v1.Rule{APIGroups: []string{"autoscaling"}, APIVersions: []string{"v2"}, Resources: []string{"horizontalpodautoscalers"}},
+		}},
+	}
+	hpaRequest := &admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Group: "autoscaling", Version: "v1", Kind: "HorizontalPodAutoscaler"},
+		Resource:  metav1.GroupVersionResource{Group: "autoscaling", Version: "v1", Resource: "horizontalpodautoscalers"},
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: []byte(`{"apiVersion":"autoscaling/v1","kind":"HorizontalPodAutoscaler","metadata":{"name":"foo"},"spec":{"targetCPUUtilizationPercentage":50}}`)},
+	}
+	got, err = hpa.MatchEquivalent(context.Background(), hpaRequest, equivalents)
+	if err != nil || got != hpaRequest {
+		t.Errorf("Wanted request as is, got %v %v", got, err)
+	}
+	if hpa.MatchesRules(got) {
+		t.Error("Unconverted request should not match the rules")
+	}
+
+	d.Mutating = true
+	if got, err := d.MatchEquivalent(context.Background(), request, equivalents); err != nil || got != request {
+		t.Errorf("Wanted request as is for a mutating webhook, got %v %v", got, err)
+	}
+	d.Mutating = false
+	d.MatchPolicy = v1.Exact
+	if got, err := d.MatchEquivalent(context.Background(), request, equivalents); err != nil || got != request {
+		t.Errorf("Wanted request as is with Exact, got %v %v", got, err)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	responses := map[string]*admissionv1.AdmissionResponse{
+		"allow.webhook": {Allowed: true, Warnings: []string{"careful"}},
+		"deny.webhook": {
+			Result:           &metav1.Status{Code: http.StatusUnprocessableEntity, Message: "nope"},
+			AuditAnnotations: map[string]string{"reason": "policy"},
+		},
+		"other.webhook": {Result: &metav1.Status{Message: "also nope"}},
+	}
+	ds := NewDelegates()
+	for _, name := range []string{"allow.webhook", "deny.webhook", "other.webhook"} {
+		srv := newDelegateServer(t, 0, responses[name])
+		defer srv.Close()
+		delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+		if err != nil {
+			t.Fatalf("Failed to create delegate: %s", err)
+		}
+		defer delegate.Close()
+		delegate.Name = name
+		delegate.Configuration = "config"
+		ds.Add(delegate)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admit-all?webhooks=allow.*,config/deny.webhook", nil)
+	selected, err := SelectDelegates(req, ds.All())
+	if err != nil {
+		t.Fatalf("SelectDelegates failed: %s", err)
+	}
+	if len(selected) != 2 || selected[0].Name != "allow.webhook" || selected[1].Name != "deny.webhook" {
+		t.Fatalf("Unexpected delegates selected: %v", selected)
+	}
+	if _, err := SelectDelegates(httptest.NewRequest(http.MethodPost, "/admit-all?webhooks=[", nil), ds.All()); err == nil {
+		t.Error("Expected error for bad glob")
+	}
+
+	var calls []Call
+	for _, d := range ds.All() {
+		calls = append(calls, Call{Delegate: d, Request: &admissionv1.AdmissionRequest{UID: "test-uid"}})
+	}
+	got := Aggregate("test-uid", FanOut(context.Background(), calls))
+	if got.Allowed {
+		t.Fatal("Expected request to be denied")
+	}
+	if got.UID != "test-uid" {
+		t.Errorf("UID mismatch got %s", got.UID)
+	}
+	if got.Result.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Wanted code of the first denial got %d", got.Result.Code)
+	}
+	for _, want := range []string{`"config/deny.webhook" denied the request: nope`, `"config/other.webhook" denied the request: also nope`} {
+		if !strings.Contains(got.Result.Message, want) {
+			t.Errorf("Wanted %q in message %q", want, got.Result.Message)
+		}
+	}
+	if len(got.Warnings) != 1 || got.Warnings[0] != "config/allow.webhook: careful" {
+		t.Errorf("Unexpected warnings %v", got.Warnings)
+	}
+	if got.AuditAnnotations["config/deny.webhook/reason"] != "policy" {
+		t.Errorf("Unexpected audit annotations %v", got.AuditAnnotations)
+	}
+
+	if got := Aggregate("test-uid", FanOut(context.Background(), calls[:1])); !got.Allowed {
+		t.Errorf("Expected request to be allowed: %+v", got.Result)
+	}
+
+	// Webhooks of the same name in different configurations are told apart.
+	got = Aggregate("test-uid", []Result{{
+		Delegate: &Delegate{Configuration: "config-a", Name: "shared.webhook"},
+		Response: &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: "a"}, AuditAnnotations: map[string]string{"reason": "a"}},
+	}, {
+		Delegate: &Delegate{Configuration: "config-b", Name: "shared.webhook"},
+		Response: &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: "b"}, AuditAnnotations: map[string]string{"reason": "b"}},
+	}})
+	if got.AuditAnnotations["config-a/shared.webhook/reason"] != "a" || got.AuditAnnotations["config-b/shared.webhook/reason"] != "b" {
+		t.Errorf("Unexpected audit annotations %v", got.AuditAnnotations)
+	}
+	for _, want := range []string{`"config-a/shared.webhook" denied the request: a`, `"config-b/shared.webhook" denied the request: b`} {
+		if !strings.Contains(got.Result.Message, want) {
+			t.Errorf("Wanted %q in message %q", want, got.Result.Message)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	// newServer returns a delegate that applies the given patch, or denies
+	// the request if it is missing the label it requires.
+	newServer := func(patch, requireLabel string, calls *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			review := &admissionv1.AdmissionReview{}
+			if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+				t.Errorf("Failed to decode request: %s", err)
+			}
+			review.Response = &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+			if patch != "" {
+				pt := admissionv1.PatchTypeJSONPatch
+				review.Response.Patch = []byte(patch)
+				review.Response.PatchType = &pt
+			}
+			if requireLabel != "" && !strings.Contains(string(review.Request.Object.Raw), requireLabel) {
+				review.Response.Allowed = false
+				review.Response.Result = &metav1.Status{Message: "missing " + requireLabel}
+			}
+			_ = json.NewEncoder(w).Encode(review)
+		}))
+	}
+	newDelegate := func(srv *httptest.Server, name string, index int) *Delegate {
+		d, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+		if err != nil {
+			t.Fatalf("Failed to create delegate: %s", err)
+		}
+		d.Name, d.Configuration, d.Index = name, "config", index
+		d.Rules = []v1.RuleWithOperations{{
+			Operations: []v1.OperationType{v1.OperationAll},
+			Rule:       v1.Rule{APIGroups: []string{"*"}, APIVersions: []string{"*"}, Resources: []string{"*"}},
+		}}
+		return d
+	}
+
+	var firstCalls, secondCalls, validateCalls int32
+	first := newServer(`[{"op":"add","path":"/metadata/labels/first","value":"true"}]`, "", &firstCalls)
+	defer first.Close()
+	second := newServer(`[{"op":"add","path":"/metadata/labels/second","value":"true"}]`, "", &secondCalls)
+	defer second.Close()
+	validator := newServer("", `"second":"true"`, &validateCalls)
+	defer validator.Close()
+
+	firstDelegate := newDelegate(first, "first.webhook", 0)
+	firstDelegate.Mutating = true
+	firstDelegate.ReinvocationPolicy = v1.IfNeededReinvocationPolicy
+	secondDelegate := newDelegate(second, "second.webhook", 1)
+	secondDelegate.Mutating = true
+	validatorDelegate := newDelegate(validator, "validate.webhook", 0)
+	for _, d := range []*Delegate{firstDelegate, secondDelegate, validatorDelegate} {
+		defer d.Close()
+	}
+
+	object := []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"pod","labels":{}}}`)
+	request := &admissionv1.AdmissionRequest{
+		UID:       "test-uid",
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: object},
+	}
+
+	p := &Pipeline{Validating: []*Delegate{validatorDelegate}}
+	if got := p.Admit(context.Background(), request, nil); got.Allowed {
+		t.Error("Expected request to be denied without the mutating delegates")
+	} else if len(got.Patch) != 0 {
+		t.Errorf("Expected no patch on denial, got %s", got.Patch)
+	}
+
+	p.Mutating = []*Delegate{firstDelegate, secondDelegate}
+	got := p.Admit(context.Background(), request, nil)
+	if !got.Allowed {
+		t.Fatalf("Expected request to be allowed: %+v", got.Result)
+	}
+	if firstCalls != 2 || secondCalls != 1 {
+		t.Errorf("Expected first delegate to be reinvoked, got %d and %d calls", firstCalls, secondCalls)
+	}
+	if got.PatchType == nil || *got.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("Expected a JSONPatch, got %v", got.PatchType)
+	}
+	patched, err := ApplyPatch(object, got.Patch)
+	if err != nil {
+		t.Fatalf("Failed to apply combined patch %s: %s", got.Patch, err)
+	}
+	if !strings.Contains(string(patched), `"first":"true"`) || !strings.Contains(string(patched), `"second":"true"`) {
+		t.Errorf("Combined patch is missing changes: %s", patched)
+	}
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	p := &Pipeline{
+		Mutating: []*Delegate{
+			{Name: "once", Timeout: time.Second},
+			{Name: "reinvoked", Timeout: 2 * time.Second, ReinvocationPolicy: v1.IfNeededReinvocationPolicy},
+		},
+		Validating: []*Delegate{
+			{Name: "short", Timeout: time.Second},
+			{Name: "default"},
+		},
+	}
+	if got, want := p.timeout(), 5*time.Second+DefaultTimeout; got != want {
+		t.Errorf("Wanted a timeout of %s, got %s", want, got)
+	}
+}
+
+func TestAddPatchedObject(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/mutate/test.webhook", nil)
+	if WantsPatchedObject(req) {
+		t.Error("Patched object not asked for")
+	}
+	req.Header.Set(PatchedObjectHeader, "true")
+	if !WantsPatchedObject(req) {
+		t.Error("Patched object asked for")
+	}
+
+	d := &Delegate{Name: "test.webhook", Mutating: true}
+	request := &admissionv1.AdmissionRequest{
+		UID:    "test-uid",
+		Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"pod"}}`)},
+	}
+	tests := []struct {
+		name        string
+		allowed     bool
+		patch       string
+		wantAllowed bool
+		wantObject  string
+	}{{
+		name:        "no patch",
+		allowed:     true,
+		wantAllowed: true,
+		wantObject:  `{"metadata":{"name":"pod"}}`,
+	}, {
+		name:        "patch",
+		allowed:     true,
+		patch:       `[{"op":"add","path":"/metadata/labels","value":{"a":"b"}}]`,
+		wantAllowed: true,
+		wantObject:  `{"metadata":{"labels":{"a":"b"},"name":"pod"}}`,
+	}, {
+		name:    "patch does not apply",
+		allowed: true,
+		patch:   `[{"op":"replace","path":"/spec/image","value":"x"}]`,
+	}, {
+		name:    "patched object too large",
+		allowed: true,
+		patch:   `[{"op":"add","path":"/metadata/labels","value":{"a":"` + strings.Repeat("b", MaxPatchedObjectHeaderBytes) + `"}}]`,
+	}, {
+		name: "denied",
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &admissionv1.AdmissionResponse{UID: "test-uid", Allowed: tc.allowed, Patch: []byte(tc.patch)}
+			var got *admissionv1.AdmissionResponse
+			w := httptest.NewRecorder()
+			WithResponseHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = d.AddPatchedObject(r.Context(), request, resp)
+			})).ServeHTTP(w, req)
+			if got.Allowed != tc.wantAllowed {
+				t.Errorf("Allowed mismatch want %v got %v: %+v", tc.wantAllowed, got.Allowed, got.Result)
+			}
+			header := w.Header().Get(PatchedObjectHeader)
+			if tc.wantObject == "" {
+				if header != "" {
+					t.Errorf("Unexpected patched object %s", header)
+				}
+				return
+			}
+			patched, err := base64.StdEncoding.DecodeString(header)
+			if err != nil {
+				t.Fatalf("Failed to decode patched object %q: %s", header, err)
+			}
+			if changed, err := jsonChanged([]byte(tc.wantObject), patched); err != nil || changed {
+				t.Errorf("Patched object mismatch want %s got %s", tc.wantObject, patched)
+			}
+		})
+	}
+
+	// Without a response to return it in, asking for the patched object fails.
+	resp := &admissionv1.AdmissionResponse{UID: "test-uid", Allowed: true}
+	if got := d.AddPatchedObject(context.Background(), request, resp); got.Allowed {
+		t.Error("Wanted a failure without a response header")
+	}
+}
+
+func TestDoRequestDryRun(t *testing.T) {
+	srv := newDelegateServer(t, 0, &admissionv1.AdmissionResponse{Allowed: true})
+	defer srv.Close()
+	delegate, err := WebhookClientConfigToURLAndCert(v1.WebhookClientConfig{URL: &srv.URL})
+	if err != nil {
+		t.Fatalf("Failed to create delegate: %s", err)
+	}
+	defer delegate.Close()
+	delegate.Name = "test.webhook"
+	delegate.FailurePolicy = v1.Ignore
+
+	request := &admissionv1.AdmissionRequest{UID: "test-uid"}
+	if got := ForceDryRun(httptest.NewRequest(http.MethodPost, "/admit/test.webhook", nil), request); got != request {
+		t.Error("Request changed without dryRun parameter")
+	}
+	forced := ForceDryRun(httptest.NewRequest(http.MethodPost, "/admit/test.webhook?dryRun=true", nil), request)
+	if !isDryRun(forced) || isDryRun(request) {
+		t.Errorf("Expected only the returned request to be a dry run, got %v and %v", forced.DryRun, request.DryRun)
+	}
+
+	for _, sideEffects := range []v1.SideEffectClass{"", v1.SideEffectClassUnknown, v1.SideEffectClassSome} {
+		delegate.SideEffects = sideEffects
+		if got := DoRequest(context.Background(), delegate, request); !got.Allowed {
+			t.Errorf("%q: Expected request to be allowed: %+v", sideEffects, got.Result)
+		}
+		got := DoRequest(context.Background(), delegate, forced)
+		if got.Allowed || got.Result.Code != http.StatusBadRequest {
+			t.Errorf("%q: Expected dry run to be rejected, got %+v", sideEffects, got.Result)
+		}
+	}
+	for _, sideEffects := range []v1.SideEffectClass{v1.SideEffectClassNone, v1.SideEffectClassNoneOnDryRun} {
+		delegate.SideEffects = sideEffects
+		if got := DoRequest(context.Background(), delegate, forced); !got.Allowed {
+			t.Errorf("%q: Expected dry run to be allowed: %+v", sideEffects, got.Result)
+		}
+	}
+}
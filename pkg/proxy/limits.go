@@ -0,0 +1,99 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"knative.dev/pkg/logging"
+)
+
+// DefaultMaxBodyBytes is used for both directions unless configured otherwise.
+const DefaultMaxBodyBytes = 8 << 20
+
+var (
+	// ErrRequestTooLarge is returned when the AdmissionReview we got, or
+	// are about to send to a delegate, is larger than allowed.
+	ErrRequestTooLarge = errors.New("admission request body too large")
+	// ErrResponseTooLarge is returned when the delegate response is larger
+	// than allowed.
+	ErrResponseTooLarge = errors.New("delegate response body too large")
+)
+
+// BodyLimits bounds the size of the bodies we are willing to handle.
+type BodyLimits struct {
+	// MaxRequestBytes is the largest AdmissionReview we accept from callers
+	// and send on to delegates.
+	MaxRequestBytes int64
+	// MaxResponseBytes is the largest AdmissionReview we read back from a
+	// delegate.
+	MaxResponseBytes int64
+}
+
+// bodyLimitsKey is used as the key for associating BodyLimits with the
+// context.
+type bodyLimitsKey struct{}
+
+// WithBodyLimits associates the BodyLimits with the context.
+func WithBodyLimits(ctx context.Context, limits BodyLimits) context.Context {
+	return context.WithValue(ctx, bodyLimitsKey{}, limits)
+}
+
+// GetBodyLimits retrieves BodyLimits associated with the given context via
+// WithBodyLimits (above). Limits that are not set are defaulted.
+func GetBodyLimits(ctx context.Context) BodyLimits {
+	limits, _ := ctx.Value(bodyLimitsKey{}).(BodyLimits)
+	if limits.MaxRequestBytes <= 0 {
+		limits.MaxRequestBytes = DefaultMaxBodyBytes
+	}
+	if limits.MaxResponseBytes <= 0 {
+		limits.MaxResponseBytes = DefaultMaxBodyBytes
+	}
+	return limits
+}
+
+// LimitRequestBody wraps the handler so that request bodies over max bytes
+// are refused before it gets to read, let alone decode them. Requests that
+// say how big they are up front are refused right away, others once they go
+// over the limit.
+func LimitRequestBody(handler http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			logging.FromContext(r.Context()).Errorf("Request body of %d bytes over the limit of %d", r.ContentLength, max)
+			http.Error(w, fmt.Sprintf("%s: limit is %d bytes", ErrRequestTooLarge, max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// limitedReader reads from r and fails with ErrResponseTooLarge once more
+// than n bytes have been read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// Read one more than allowed so that we can tell if it's over.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/admission"
+	"github.com/google/cel-go/cel"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/admissionregistration/v1"
+)
+
+// matchCondition is a compiled MatchCondition of a webhook.
+type matchCondition struct {
+	name    string
+	program cel.Program
+}
+
+// matchConditionEnv is the CEL environment MatchConditions are compiled in.
+// Unlike in the kube-apiserver, there is no authorizer variable since we
+// have nothing to authorize against.
+var matchConditionEnv, matchConditionEnvErr = admission.NewEnv()
+
+// SetMatchConditions compiles the MatchConditions of the webhook. Errors for
+// all the conditions that fail to compile are returned together, and are
+// also kept on the Delegate so that MatchesConditions fails for every request
+// until the conditions are fixed.
+func (d *Delegate) SetMatchConditions(conditions []v1.MatchCondition) error {
+	d.matchConditions, d.matchConditionsErr = compileMatchConditions(conditions)
+	return d.matchConditionsErr
+}
+
+func compileMatchConditions(conditions []v1.MatchCondition) ([]matchCondition, error) {
+	if matchConditionEnvErr != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", matchConditionEnvErr)
+	}
+	compiled := make([]matchCondition, 0, len(conditions))
+	var errs []error
+	for _, c := range conditions {
+		program, err := admission.Compile(matchConditionEnv, c.Expression)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("matchCondition %q: %w", c.Name, err))
+			continue
+		}
+		compiled = append(compiled, matchCondition{name: c.Name, program: program})
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return compiled, nil
+}
+
+// MatchesConditions evaluates the MatchConditions of the webhook against the
+// request. Like in the kube-apiserver, any condition evaluating to false means
+// no match, and returns its name. Otherwise any evaluation error is returned,
+// as is the error of conditions that failed to compile.
+func (d *Delegate) MatchesConditions(request *admissionv1.AdmissionRequest) (bool, string, error) {
+	if d.matchConditionsErr != nil {
+		return false, "", fmt.Errorf("invalid matchConditions: %w", d.matchConditionsErr)
+	}
+	if len(d.matchConditions) == 0 {
+		return true, "", nil
+	}
+	vars, err := admission.Vars(request)
+	if err != nil {
+		return false, "", err
+	}
+	var errs []error
+	for _, c := range d.matchConditions {
+		matched, err := admission.Eval(c.program, vars)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("matchCondition %q: %w", c.name, err))
+			continue
+		}
+		if !matched {
+			return false, c.name, nil
+		}
+	}
+	if len(errs) > 0 {
+		return false, "", errors.Join(errs...)
+	}
+	return true, "", nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+)
+
+var (
+	retryCountM = stats.Int64(
+		"delegate_retry_count",
+		"The number of calls to a delegate that were retried",
+		stats.UnitDimensionless)
+	breakerStateM = stats.Int64(
+		"delegate_breaker_state",
+		"The state of the delegate circuit breaker: 0 closed, 1 half-open, 2 open",
+		stats.UnitDimensionless)
+	failureCountM = stats.Int64(
+		"delegate_failure_count",
+		"The number of calls to a delegate that failed",
+		stats.UnitDimensionless)
+	cancelledCountM = stats.Int64(
+		"delegate_cancelled_count",
+		"The number of calls to a delegate that were cancelled by the caller",
+		stats.UnitDimensionless)
+
+	webhookKey = tag.MustNewKey("webhook")
+)
+
+func init() {
+	if err := view.Register(
+		&view.View{
+			Description: retryCountM.Description(),
+			Measure:     retryCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{webhookKey},
+		},
+		&view.View{
+			Description: failureCountM.Description(),
+			Measure:     failureCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{webhookKey},
+		},
+		&view.View{
+			Description: cancelledCountM.Description(),
+			Measure:     cancelledCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{webhookKey},
+		},
+		&view.View{
+			Description: breakerStateM.Description(),
+			Measure:     breakerStateM,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{webhookKey},
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
+// record records the measurement tagged with the webhook it is for.
+func record(ctx context.Context, webhook string, ms stats.Measurement) {
+	tagged, err := tag.New(ctx, tag.Insert(webhookKey, webhook))
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Failed to tag metric for %s: %s", webhook, err)
+		return
+	}
+	metrics.Record(tagged, ms)
+}
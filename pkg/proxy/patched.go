@@ -0,0 +1,91 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// PatchedObjectHeader can be set to "true" by callers of mutating delegates
+// that want the object with the patch of the delegate applied back, so they
+// don't have to apply the JSONPatch themselves. The patched object is then
+// returned in the header of the same name of the HTTP response, as base64
+// encoded JSON, since AdmissionResponses have no place for objects.
+const PatchedObjectHeader = "X-Proxy-Patched-Object"
+
+// MaxPatchedObjectHeaderBytes is how large the base64 encoded patched object
+// in the PatchedObjectHeader can get. Go HTTP clients, like the one of OPA's
+// http.send, refuse response headers over 1MiB by default, so this leaves
+// room for the other headers.
+const MaxPatchedObjectHeaderBytes = 512 << 10
+
+// responseHeaderKey is used as the key for associating the header of the
+// HTTP response to the caller with the context.
+type responseHeaderKey struct{}
+
+// WithResponseHeaders wraps the handler so that the header of the HTTP
+// response is associated with the context of the requests it gets, see
+// GetResponseHeader.
+func WithResponseHeaders(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseHeaderKey{}, w.Header())))
+	})
+}
+
+// GetResponseHeader retrieves the header of the HTTP response associated with
+// the given context via WithResponseHeaders (above), or nil if there is none.
+func GetResponseHeader(ctx context.Context) http.Header {
+	h, _ := ctx.Value(responseHeaderKey{}).(http.Header)
+	return h
+}
+
+// WantsPatchedObject returns whether the caller asked for the patched object
+// with the PatchedObjectHeader.
+func WantsPatchedObject(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	want, _ := strconv.ParseBool(req.Header.Get(PatchedObjectHeader))
+	return want
+}
+
+// PatchedObject returns the object of the request with the patch in the
+// response applied.
+func PatchedObject(request *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse) ([]byte, error) {
+	if len(response.Patch) == 0 {
+		return request.Object.Raw, nil
+	}
+	return ApplyPatch(request.Object.Raw, response.Patch)
+}
+
+// AddPatchedObject sets the PatchedObjectHeader of the response to the
+// caller for an allowed response from the delegate. If the patch does not
+// apply, the patched object is over MaxPatchedObjectHeaderBytes, or there is
+// no response header to set, the response is replaced by a failure saying so.
+func (d *Delegate) AddPatchedObject(ctx context.Context, request *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+	if !response.Allowed {
+		return response
+	}
+	header := GetResponseHeader(ctx)
+	if header == nil {
+		return CreateFailResponse(request.UID, "Can not return the patched object, no response header")
+	}
+	patched, err := PatchedObject(request, response)
+	if err != nil {
+		return CreateFailResponse(request.UID, fmt.Sprintf("Failed to apply patch from webhook %q: %s", d.Name, err))
+	}
+	if size := base64.StdEncoding.EncodedLen(len(patched)); size > MaxPatchedObjectHeaderBytes {
+		return CreateFailResponse(request.UID, fmt.Sprintf("Patched object from webhook %q is too large for the %s header: %d bytes encoded, limit is %d", d.Name, PatchedObjectHeader, size, MaxPatchedObjectHeaderBytes))
+	}
+	header.Set(PatchedObjectHeader, base64.StdEncoding.EncodeToString(patched))
+	return response
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	patchgen "gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/logging"
+)
+
+// ErrNoObject is returned when patching a request without an object, like
+// a DELETE.
+var ErrNoObject = errors.New("request has no object")
+
+// Pipeline calls delegates the way the kube-apiserver calls webhooks: first
+// the mutating ones one after the other, each seeing the object as patched by
+// the ones before it, and then the validating ones on the final object.
+type Pipeline struct {
+	// Mutating delegates, in the order to call them.
+	Mutating []*Delegate
+	// Validating delegates, which are called at the same time.
+	Validating  []*Delegate
+	Equivalents *EquivalentResources
+}
+
+// Admit runs the request through the pipeline. The response is only allowed
+// if every delegate called allowed it, and then has a patch from the original
+// object to the one the validating delegates saw, if they differ. Like with
+// Aggregate, denials, warnings and audit annotations are attributed to the
+// delegate they came from.
+func (p *Pipeline) Admit(ctx context.Context, request *admissionv1.AdmissionRequest, ns *corev1.Namespace) *admissionv1.AdmissionResponse {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout())
+	defer cancel()
+
+	current := request.DeepCopy()
+	var results []Result
+	// changes counts the changes made to the object, and calledAt has the
+	// count as of right after each delegate was last called.
+	changes := 0
+	calledAt := make(map[*Delegate]int, len(p.Mutating))
+	call := func(d *Delegate) bool {
+		resp, object, called := d.mutate(ctx, current, ns, p.Equivalents)
+		if !called {
+			return true
+		}
+		results = append(results, Result{Delegate: d, Response: resp})
+		if !resp.Allowed {
+			return false
+		}
+		if changed, err := jsonChanged(current.Object.Raw, object); err != nil || changed {
+			current.Object.Raw = object
+			changes++
+		}
+		calledAt[d] = changes
+		return true
+	}
+	for _, d := range p.Mutating {
+		if !call(d) {
+			return Aggregate(request.UID, results)
+		}
+	}
+	// Same as the kube-apiserver, delegates that asked for it get called once
+	// more if the object was changed after they were called.
+	for _, d := range p.Mutating {
+		if at, ok := calledAt[d]; ok && d.ReinvocationPolicy == v1.IfNeededReinvocationPolicy && changes > at {
+			logging.FromContext(ctx).Debugf("Reinvoking %s/%s", d.Configuration, d.Name)
+			if !call(d) {
+				return Aggregate(request.UID, results)
+			}
+		}
+	}
+
+	calls, failed := Calls(ctx, current, ns, p.Validating, p.Equivalents)
+	results = append(results, failed...)
+	results = append(results, FanOut(ctx, calls)...)
+	ret := Aggregate(request.UID, results)
+	if changed, _ := jsonChanged(request.Object.Raw, current.Object.Raw); !ret.Allowed || !changed {
+		return ret
+	}
+	patch, err := CreatePatch(request.Object.Raw, current.Object.Raw)
+	if err != nil {
+		return CreateFailResponse(request.UID, fmt.Sprintf("Failed to create patch: %s", err))
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	ret.Patch = patch
+	ret.PatchType = &patchType
+	return ret
+}
+
+// timeout returns how long the kube-apiserver could take calling all the
+// delegates: the mutating ones one after the other, including once more for
+// the ones that may be reinvoked, and then the longest of the validating ones.
+func (p *Pipeline) timeout() time.Duration {
+	var total time.Duration
+	for _, d := range p.Mutating {
+		total += d.timeout()
+		if d.ReinvocationPolicy == v1.IfNeededReinvocationPolicy {
+			total += d.timeout()
+		}
+	}
+	var longest time.Duration
+	for _, d := range p.Validating {
+		if t := d.timeout(); t > longest {
+			longest = t
+		}
+	}
+	return total + longest
+}
+
+// mutate calls the delegate if it matches the request, and returns its
+// response and the object of the request with its patch applied. called is
+// false if the delegate does not match the request.
+func (d *Delegate) mutate(ctx context.Context, request *admissionv1.AdmissionRequest, ns *corev1.Namespace, equivalents *EquivalentResources) (response *admissionv1.AdmissionResponse, object []byte, called bool) {
+	forward, reason, err := d.MatchRequest(ctx, request, ns, equivalents)
+	if err != nil {
+		return d.ErrorResponse(ctx, request.UID, err), request.Object.Raw, true
+	}
+	if reason != "" {
+		logging.FromContext(ctx).Debugf("Request not matched by the %s of %s/%s, skipping", reason, d.Configuration, d.Name)
+		return nil, request.Object.Raw, false
+	}
+	response = DoRequest(ctx, d, forward)
+	if !response.Allowed {
+		return response, request.Object.Raw, true
+	}
+	patched, err := PatchedObject(request, response)
+	if err != nil {
+		// The kube-apiserver treats patches it can not apply as failures to
+		// call the webhook.
+		return d.ErrorResponse(ctx, request.UID, err), request.Object.Raw, true
+	}
+	return response, patched, true
+}
+
+// ApplyPatch applies the JSONPatch to the object.
+func ApplyPatch(object, patch []byte) ([]byte, error) {
+	if len(object) == 0 {
+		return nil, fmt.Errorf("failed to apply patch: %w", ErrNoObject)
+	}
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode patch: %w", err)
+	}
+	patched, err := p.Apply(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply patch: %w", err)
+	}
+	return patched, nil
+}
+
+// CreatePatch returns the JSONPatch that turns from into to.
+func CreatePatch(from, to []byte) ([]byte, error) {
+	ops, err := patchgen.CreatePatch(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
+
+// jsonChanged returns whether the two JSON documents differ, ignoring
+// formatting and the order of fields.
+func jsonChanged(a, b []byte) (bool, error) {
+	if bytes.Equal(a, b) {
+		return false, nil
+	}
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		return true, err
+	}
+	if err := json.Unmarshal(b, &bv); err != nil {
+		return true, err
+	}
+	return !reflect.DeepEqual(av, bv), nil
+}
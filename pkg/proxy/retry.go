@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"syscall"
+	"time"
+)
+
+// ErrBreakerOpen is returned instead of calling a delegate whose circuit
+// breaker is open.
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// RetryOptions controls how failed calls to delegates are retried and when
+// we stop calling them altogether.
+type RetryOptions struct {
+	// Attempts is the maximum number of calls made for a single request,
+	// including the first one.
+	Attempts int
+	// Backoff is the base delay between attempts. It doubles on every
+	// attempt, up to a minute, and is jittered.
+	Backoff time.Duration
+	// BreakerThreshold is the number of consecutive failures after which
+	// the circuit breaker opens. 0 disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before letting a
+	// probe through.
+	BreakerCooldown time.Duration
+}
+
+// retryOptionsKey is used as the key for associating RetryOptions with the
+// context.
+type retryOptionsKey struct{}
+
+// WithRetryOptions associates the RetryOptions with the context.
+func WithRetryOptions(ctx context.Context, opts RetryOptions) context.Context {
+	return context.WithValue(ctx, retryOptionsKey{}, opts)
+}
+
+// GetRetryOptions retrieves RetryOptions associated with the given context
+// via WithRetryOptions (above). If there are none, no retries are done and
+// the breaker is disabled.
+func GetRetryOptions(ctx context.Context) RetryOptions {
+	v := ctx.Value(retryOptionsKey{})
+	if v == nil {
+		return RetryOptions{}
+	}
+	return v.(RetryOptions)
+}
+
+// maxBackoff caps the delay between attempts, which would otherwise
+// overflow for large numbers of attempts.
+const maxBackoff = time.Minute
+
+// backoff returns how long to wait before the attempt after the given one.
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	if o.Backoff <= 0 {
+		return 0
+	}
+	d := o.Backoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	// Wait at least half of it, and a random amount of the other half.
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1)) //nolint:gosec // jitter does not need a secure source
+}
+
+// retryableError marks failures where the delegate did not process the
+// request, so it is safe to send it again.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable checks if the call to the delegate can be retried.
+func isRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re) || errors.Is(err, syscall.ECONNREFUSED)
+}
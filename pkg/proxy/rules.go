@@ -0,0 +1,165 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typesv1 "k8s.io/apimachinery/pkg/types"
+)
+
+// NotMatchedAnnotation is the audit annotation set on responses for requests
+// that the webhook would not have been called for by the kube-apiserver. The
+// value says what did not match.
+const NotMatchedAnnotation = "proxy.chainguard.dev/not-matched"
+
+// CreateNotMatchedResponse allows a request that the webhook is not
+// interested in, saying why.
+func CreateNotMatchedResponse(uid typesv1.UID, webhook, reason string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		UID:     uid,
+		Allowed: true,
+		Result: &metav1.Status{
+			Code:    http.StatusOK,
+			Message: fmt.Sprintf("request not matched by the %s of webhook %q", reason, webhook),
+		},
+		AuditAnnotations: map[string]string{NotMatchedAnnotation: reason},
+	}
+}
+
+// FilteredAnnotation is the audit annotation set on responses for requests
+// that were let through without calling any webhook. The value is the filter
+// that decided so.
+const FilteredAnnotation = "proxy.chainguard.dev/filtered-by"
+
+// CreateFilteredResponse allows a request that a filter decided not to
+// proxy, saying which.
+func CreateFilteredResponse(uid typesv1.UID, filter string) *admissionv1.AdmissionResponse {
+	ret := CreateAllowResponse(uid)
+	ret.AuditAnnotations = map[string]string{FilteredAnnotation: filter}
+	return ret
+}
+
+// MatchesRules checks if the request is matched by any of the Rules of the
+// webhook, the same way the kube-apiserver decides whether to call it.
+func (d *Delegate) MatchesRules(request *admissionv1.AdmissionRequest) bool {
+	for i := range d.Rules {
+		if ruleMatches(&d.Rules[i], request) {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleMatches(rule *v1.RuleWithOperations, request *admissionv1.AdmissionRequest) bool {
+	return operationMatches(rule.Operations, request.Operation) &&
+		stringMatches(rule.APIGroups, request.Resource.Group) &&
+		stringMatches(rule.APIVersions, request.Resource.Version) &&
+		resourceMatches(rule.Resources, request.Resource.Resource, request.SubResource) &&
+		scopeMatches(rule.Scope, request)
+}
+
+func operationMatches(ops []v1.OperationType, op admissionv1.Operation) bool {
+	for _, o := range ops {
+		if o == v1.OperationAll || string(o) == string(op) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringMatches(want []string, got string) bool {
+	for _, w := range want {
+		if w == "*" || w == got {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceMatches handles the resource/subresource forms of the rules, like
+// "pods", "pods/status", "*/status", "pods/*" and "*/*". Note that "*" only
+// matches resources, not their subresources.
+func resourceMatches(want []string, resource, subResource string) bool {
+	for _, w := range want {
+		res, sub, _ := strings.Cut(w, "/")
+		if (res == "*" || res == resource) && (sub == "*" || sub == subResource) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeMatches checks the scope of the rule. Namespaces themselves are
+// cluster scoped, even though the request has the namespace set to the name
+// of the namespace.
+func scopeMatches(scope *v1.ScopeType, request *admissionv1.AdmissionRequest) bool {
+	if scope == nil || *scope == v1.AllScopes {
+		return true
+	}
+	isNamespace := IsNamespaceRequest(request)
+	switch *scope {
+	case v1.NamespacedScope:
+		return !isNamespace && request.Namespace != ""
+	case v1.ClusterScope:
+		return isNamespace || request.Namespace == ""
+	}
+	return false
+}
+
+// Matches checks whether the kube-apiserver would call the webhook for the
+// request. If not, it returns what did not match. ns is the namespace of the
+// request, if there is one.
+func (d *Delegate) Matches(request *admissionv1.AdmissionRequest, ns *corev1.Namespace) (string, error) {
+	if !d.MatchesRules(request) {
+		return "rules", nil
+	}
+	matched, err := d.MatchesNamespace(request, ns)
+	if err != nil {
+		return "", fmt.Errorf("failed to match namespaceSelector: %w", err)
+	}
+	if !matched {
+		return "namespaceSelector", nil
+	}
+	if matched, err = d.MatchesObject(request); err != nil {
+		return "", fmt.Errorf("failed to match objectSelector: %w", err)
+	}
+	if !matched {
+		return "objectSelector", nil
+	}
+	matched, condition, err := d.MatchesConditions(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate matchConditions: %w", err)
+	}
+	if !matched {
+		return fmt.Sprintf("matchCondition %s", condition), nil
+	}
+	return "", nil
+}
+
+// MatchRequest returns the request to send to the webhook, converted to an
+// equivalent resource if need be, see MatchEquivalent. If the kube-apiserver
+// would not call the webhook for the request, it returns what did not match
+// instead. Errors mean we can not tell, which the kube-apiserver treats as
+// failing to call the webhook.
+func (d *Delegate) MatchRequest(ctx context.Context, request *admissionv1.AdmissionRequest, ns *corev1.Namespace, equivalents *EquivalentResources) (*admissionv1.AdmissionRequest, string, error) {
+	converted, err := d.MatchEquivalent(ctx, request, equivalents)
+	if err != nil {
+		return nil, "", err
+	}
+	reason, err := d.Matches(converted, ns)
+	if err != nil || reason != "" {
+		return nil, reason, err
+	}
+	return converted, "", nil
+}
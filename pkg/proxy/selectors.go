@@ -0,0 +1,96 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/admission"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// SetSelectors parses the NamespaceSelector and ObjectSelector of the
+// webhook. A nil selector matches everything, like in the kube-apiserver.
+func (d *Delegate) SetSelectors(namespaceSelector, objectSelector *metav1.LabelSelector) error {
+	var err error
+	if d.namespaceSelector, err = toSelector(namespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespaceSelector: %w", err)
+	}
+	if d.objectSelector, err = toSelector(objectSelector); err != nil {
+		return fmt.Errorf("invalid objectSelector: %w", err)
+	}
+	return nil
+}
+
+func toSelector(ls *metav1.LabelSelector) (labels.Selector, error) {
+	if ls == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(ls)
+}
+
+// MatchesNamespace checks the NamespaceSelector of the webhook against the
+// namespace of the request. Cluster scoped requests always match, except for
+// Namespaces themselves whose own labels are checked, since the namespace may
+// not exist yet or be about to change. ns is the namespace of the request, if there is one.
+func (d *Delegate) MatchesNamespace(request *admissionv1.AdmissionRequest, ns *corev1.Namespace) (bool, error) {
+	if d.namespaceSelector == nil || d.namespaceSelector.Empty() {
+		return true, nil
+	}
+	if IsNamespaceRequest(request) {
+		// Like the kube-apiserver, use the new object unless it's being
+		// deleted, when there is only the old one.
+		raw := request.Object
+		if request.Operation == admissionv1.Delete {
+			raw = request.OldObject
+		}
+		l, err := admission.ObjectLabels(raw)
+		if err != nil || l == nil {
+			return false, err
+		}
+		return d.namespaceSelector.Matches(labels.Set(l)), nil
+	}
+	if request.Namespace == "" {
+		return true, nil
+	}
+	if ns == nil {
+		return false, fmt.Errorf("namespace %s not found", request.Namespace)
+	}
+	return d.namespaceSelector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// MatchesObject checks the ObjectSelector of the webhook against the labels
+// of the object and the old object of the request. It's a match if either of
+// them matches.
+func (d *Delegate) MatchesObject(request *admissionv1.AdmissionRequest) (bool, error) {
+	if d.objectSelector == nil || d.objectSelector.Empty() {
+		return true, nil
+	}
+	return matchesObjectLabels(d.objectSelector, request)
+}
+
+// IsNamespaceRequest checks if the request is for a Namespace object, or
+// one of its subresources, which the kube-apiserver treats the same.
+func IsNamespaceRequest(request *admissionv1.AdmissionRequest) bool {
+	return request.Resource.Group == "" && request.Resource.Version == "v1" && request.Resource.Resource == "namespaces"
+}
+
+func matchesObjectLabels(selector labels.Selector, request *admissionv1.AdmissionRequest) (bool, error) {
+	for _, raw := range []runtime.RawExtension{request.Object, request.OldObject} {
+		l, err := admission.ObjectLabels(raw)
+		if err != nil {
+			return false, err
+		}
+		if l != nil && selector.Matches(labels.Set(l)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
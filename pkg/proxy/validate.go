@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// Errors for delegate responses that the kube-apiserver would not accept.
+var (
+	ErrBadStatus       = errors.New("delegate returned a non-2xx status")
+	ErrBadTypeMeta     = errors.New("delegate returned an unexpected apiVersion/kind")
+	ErrNoResponse      = errors.New("delegate returned an AdmissionReview without a response")
+	ErrUIDMismatch     = errors.New("delegate returned a response for a different request")
+	ErrUnexpectedPatch = errors.New("delegate returned a patch from a validating webhook")
+	ErrBadPatchType    = errors.New("delegate returned a patch with an unsupported patchType")
+)
+
+// validateStatus checks that the delegate answered with a 2xx status.
+func validateStatus(code int, status string) error {
+	if code < 200 || code > 299 {
+		return fmt.Errorf("%w: %s", ErrBadStatus, status)
+	}
+	return nil
+}
+
+// validateReview checks the AdmissionReview returned by the delegate the same
+// way the kube-apiserver does before it trusts the response. A v1 review must
+// be of the same version as the one that was sent, and answer the request.
+// Like the kube-apiserver, v1beta1 reviews only need a response, which is
+// taken to answer the request, and their patches default to JSONPatch.
+func (d *Delegate) validateReview(request *admissionv1.AdmissionRequest, review *admissionv1.AdmissionReview, wantVersion string) error {
+	resp := review.Response
+	if wantVersion == admissionV1beta1 {
+		if resp == nil {
+			return ErrNoResponse
+		}
+		resp.UID = request.UID
+		if len(resp.Patch) > 0 && resp.PatchType == nil {
+			jsonPatch := admissionv1.PatchTypeJSONPatch
+			resp.PatchType = &jsonPatch
+		}
+	} else {
+		if review.APIVersion != wantVersion || review.Kind != "AdmissionReview" {
+			return fmt.Errorf("%w: wanted %s AdmissionReview, got %q %q", ErrBadTypeMeta, wantVersion, review.APIVersion, review.Kind)
+		}
+		if resp == nil {
+			return ErrNoResponse
+		}
+		if resp.UID != request.UID {
+			return fmt.Errorf("%w: wanted UID %q, got %q", ErrUIDMismatch, request.UID, resp.UID)
+		}
+	}
+	if !d.Mutating {
+		// Same as the kube-apiserver, only an actual patch is a problem.
+		if len(resp.Patch) > 0 {
+			return ErrUnexpectedPatch
+		}
+		return nil
+	}
+	if len(resp.Patch) == 0 && resp.PatchType == nil {
+		return nil
+	}
+	if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+		got := "<none>"
+		if resp.PatchType != nil {
+			got = string(*resp.PatchType)
+		}
+		return fmt.Errorf("%w: wanted %s, got %s", ErrBadPatchType, admissionv1.PatchTypeJSONPatch, got)
+	}
+	return nil
+}
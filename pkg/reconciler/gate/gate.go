@@ -0,0 +1,70 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package gate decides whether requests get to the delegates at all, the
+// same way for all the admission controllers.
+package gate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"knative.dev/pkg/logging"
+)
+
+// Gate looks up the namespace of requests and runs them through the filters.
+type Gate struct {
+	namespaces *filter.Namespaces
+	filters    filter.Chain
+}
+
+// New returns a Gate getting namespaces from namespaces, and running
+// requests through filters.
+func New(namespaces *filter.Namespaces, filters filter.Chain) *Gate {
+	return &Gate{namespaces: namespaces, filters: filters}
+}
+
+// Admit returns the Namespace of the request, if any. If the request should
+// not be proxied, or the Namespace can not be fetched, the response to return
+// instead is returned. The Namespace is only fetched once the filters that
+// do not need it let the request through.
+func (g *Gate) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) (*corev1.Namespace, *admissionv1.AdmissionResponse) {
+	var (
+		ns     *corev1.Namespace
+		nsErr  error
+		looked bool
+	)
+	namespace := func() (*corev1.Namespace, error) {
+		if !looked && request.Namespace != "" {
+			looked = true
+			ns, nsErr = g.namespaces.Get(ctx, request.Namespace)
+		}
+		return ns, nsErr
+	}
+	decision, by, err := g.filters.Decide(ctx, request, namespace)
+	if err == nil && decision != filter.Skip {
+		// The delegates need the namespace even if no filter did.
+		_, err = namespace()
+	}
+	if nsErr != nil {
+		logging.FromContext(ctx).Warnf("Failed to get namespace %s: %s", request.Namespace, nsErr)
+		return nil, proxy.CreateNamespaceErrorResponse(request.UID, request.Namespace, nsErr, g.namespaces.FailurePolicy)
+	}
+	if err != nil {
+		return nil, proxy.CreateFailResponse(request.UID, fmt.Sprintf("Failed to decide whether to proxy: %s", err))
+	}
+	if decision == filter.Skip {
+		logging.FromContext(ctx).Debugf("Request %s skipped by filter %s, letting through", request.UID, by)
+		return nil, proxy.CreateFilteredResponse(request.UID, by)
+	}
+	logging.FromContext(ctx).Debugf("Request %s proxied, decided by filter %q", request.UID, by)
+	return ns, nil
+}
@@ -7,12 +7,15 @@ package mutating
 
 import (
 	"context"
+	"sync"
 
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
 	mwhinformer "knative.dev/pkg/client/injection/kube/informers/admissionregistration/v1/mutatingwebhookconfiguration"
 	nsinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/namespace"
 
 	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
 	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/gate"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/logging"
@@ -20,20 +23,48 @@ import (
 
 const queueName = "ProxyMutatingWebhook"
 
-func NewController(ctx context.Context, _ configmap.Watcher) *controller.Impl {
-	mwhInformer := mwhinformer.Get(ctx)
-	nsInformer := nsinformer.Get(ctx)
-	r := &Reconciler{
-		delegates:    make(map[string]*proxy.Delegate),
-		mwhlister:    mwhInformer.Lister(),
-		nslister:     nsInformer.Lister(),
-		requireLabel: filter.GetRequireLabel(ctx),
-	}
-	impl := controller.NewContext(ctx, r, controller.ControllerOptions{
+// Controllers creates the controllers that share one Reconciler, so that
+// the delegates, and their transports and circuit breakers, are only kept
+// once.
+type Controllers struct {
+	once       sync.Once
+	reconciler *Reconciler
+}
+
+// Reconciler returns the shared Reconciler, creating it the first time.
+func (c *Controllers) Reconciler(ctx context.Context) *Reconciler {
+	c.once.Do(func() {
+		c.reconciler = NewReconciler(ctx)
+	})
+	return c.reconciler
+}
+
+// NewController returns the controller for the /mutate endpoint, which also
+// keeps the delegates of the shared Reconciler up to date.
+func (c *Controllers) NewController(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+	impl := controller.NewContext(ctx, c.Reconciler(ctx), controller.ControllerOptions{
 		WorkQueueName: queueName,
 		Logger:        logging.FromContext(ctx).Named(queueName),
 	})
 
-	_, _ = mwhInformer.Informer().AddEventHandler(controller.HandleAll(impl.Enqueue))
+	_, _ = mwhinformer.Get(ctx).Informer().AddEventHandler(controller.HandleAll(impl.Enqueue))
 	return impl
 }
+
+func NewController(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+	return (&Controllers{}).NewController(ctx, cmw)
+}
+
+// NewReconciler returns a Reconciler with its own set of delegates, for
+// controllers that need to keep track of the MutatingWebhookConfigurations
+// themselves.
+func NewReconciler(ctx context.Context) *Reconciler {
+	return &Reconciler{
+		delegates:   proxy.NewDelegates(),
+		mwhlister:   mwhinformer.Get(ctx).Lister(),
+		gate:        gate.New(filter.NewNamespaces(nsinformer.Get(ctx).Lister(), kubeclient.Get(ctx).CoreV1(), filter.GetNamespaceLookupOptions(ctx)), filter.GetChain(ctx)),
+		retry:       proxy.GetRetryOptions(ctx),
+		limits:      proxy.GetBodyLimits(ctx),
+		equivalents: proxy.NewEquivalentResources(kubeclient.Get(ctx).Discovery()),
+	}
+}
@@ -8,15 +8,15 @@ package mutating
 import (
 	"context"
 	"fmt"
-	"sync"
 
 	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
 	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/gate"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/webhooks"
 
 	admissionv1 "k8s.io/api/admission/v1"
-	v1 "k8s.io/api/admissionregistration/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	admissionlisters "k8s.io/client-go/listers/admissionregistration/v1"
-	nslisters "k8s.io/client-go/listers/core/v1"
 
 	"knative.dev/pkg/apis"
 	"knative.dev/pkg/controller"
@@ -29,12 +29,13 @@ const mutatePrefix = "/mutate/"
 // Reconciler implements the meta AdmissionController
 type Reconciler struct {
 	webhook.StatelessAdmissionImpl
-	mwhlister    admissionlisters.MutatingWebhookConfigurationLister
-	nslister     nslisters.NamespaceLister
-	requireLabel bool
+	mwhlister   admissionlisters.MutatingWebhookConfigurationLister
+	gate        *gate.Gate
+	retry       proxy.RetryOptions
+	limits      proxy.BodyLimits
+	equivalents *proxy.EquivalentResources
 
-	m         sync.Mutex
-	delegates map[string]*proxy.Delegate
+	delegates *proxy.Delegates
 }
 
 var _ controller.Reconciler = (*Reconciler)(nil)
@@ -42,41 +43,22 @@ var _ webhook.AdmissionController = (*Reconciler)(nil)
 
 // Reconcile adds Client information to our map for each of the
 // MutatingWebhookConfiguration so that the Admit can call them
-// as necessary.
+// as necessary. Webhooks that are no longer in the configuration, or all of
+// them if the configuration is gone, are removed from the map.
 func (r *Reconciler) Reconcile(ctx context.Context, key string) error {
 	mwh, err := r.mwhlister.Get(key)
-	if err != nil {
-		return err
+	if apierrs.IsNotFound(err) {
+		return webhooks.Sync(ctx, r.delegates, key, nil, r.retry, r.limits)
 	}
-
-	for i := range mwh.Webhooks {
-		if err := r.addDelegate(ctx, mwh.Webhooks[i].Name, mwh.Webhooks[i].ClientConfig); err != nil {
-			logging.FromContext(ctx).Errorf("Failed to add delegate: %s", err)
-			return err
-		}
-	}
-	return nil
-}
-func (r *Reconciler) addDelegate(ctx context.Context, name string, clientConfig v1.WebhookClientConfig) error {
-	r.m.Lock()
-	defer r.m.Unlock()
-	delegate, err := proxy.WebhookClientConfigToURLAndCert(clientConfig)
 	if err != nil {
 		return err
 	}
-	r.delegates[name] = delegate
-	if clientConfig.Service != nil {
-		logging.FromContext(ctx).Infof("Added %s => Service: %+v", name, clientConfig.Service)
-	} else {
-		logging.FromContext(ctx).Infof("Added %s => URL: %s", name, *clientConfig.URL)
-	}
-	return nil
+	return webhooks.Sync(ctx, r.delegates, mwh.Name, webhooks.FromMutating(mwh.Webhooks), r.retry, r.limits)
 }
 
-func (r *Reconciler) getDelegate(name string) *proxy.Delegate {
-	r.m.Lock()
-	defer r.m.Unlock()
-	return r.delegates[name]
+// Delegates returns the delegates for the webhooks reconciled so far.
+func (r *Reconciler) Delegates() *proxy.Delegates {
+	return r.delegates
 }
 
 func (r *Reconciler) Path() string {
@@ -85,28 +67,45 @@ func (r *Reconciler) Path() string {
 
 // Admit implements webhook.AdmissionController
 func (r *Reconciler) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
-	ctx = filter.WithRequireLabel(ctx, r.requireLabel)
-	if request.Namespace != "" {
-		ns, err := r.nslister.Get(request.Namespace)
-		if err != nil {
-			return proxy.CreateFailResponse(request.UID, fmt.Sprintf("Failed to get namespace %s %s", request.Namespace, err))
-		}
-		if !filter.ShouldProxy(ctx, ns) {
-			logging.FromContext(ctx).Debugf("Namespace %s not labeled for inclusion, letting through", request.Namespace)
-			return proxy.CreateAllowResponse(request.UID)
-		}
+	ns, response := r.gate.Admit(ctx, request)
+	if response != nil {
+		return response
 	}
-
 	req := apis.GetHTTPRequest(ctx)
 	hook, response := proxy.GetHookName(ctx, mutatePrefix, request.UID, req)
 	if response != nil {
 		return response
 	}
-	delegate := r.getDelegate(hook)
-	if delegate == nil || delegate.Service == "" {
-		logging.FromContext(ctx).Errorf("No handler found for %s %s", req.URL.Path, hook)
-		return proxy.CreateFailResponse(request.UID, fmt.Sprintf("No handler found for %s %s", req.URL.Path, hook))
+	request = proxy.ForceDryRun(req, request)
+	delegate, err := r.delegates.Lookup(hook)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("No handler found for %s: %s", req.URL.Path, err)
+		return proxy.CreateFailResponse(request.UID, fmt.Sprintf("No handler found for %s: %s", req.URL.Path, err))
+	}
+	allowed, err := filter.AllowsHook(ns, delegate.Configuration, delegate.Name)
+	if err != nil {
+		return proxy.CreateFailResponse(request.UID, fmt.Sprintf("Failed to check the hooks allowed in namespace %s: %s", request.Namespace, err))
+	}
+	if !allowed {
+		logging.FromContext(ctx).Debugf("Namespace %s does not allow %s, letting through", request.Namespace, hook)
+		return proxy.CreateNotMatchedResponse(request.UID, delegate.Name, "namespace annotation")
+	}
+	forward, reason, err := delegate.MatchRequest(ctx, request, ns, r.equivalents)
+	if err != nil {
+		// Same as the kube-apiserver, not being able to tell if the webhook
+		// should be called is treated as failing to call it.
+		return delegate.ErrorResponse(ctx, request.UID, err)
+	}
+	if reason != "" {
+		logging.FromContext(ctx).Debugf("Request not matched by the %s of %s, letting through", reason, hook)
+		return proxy.CreateNotMatchedResponse(request.UID, delegate.Name, reason)
 	}
 	logging.FromContext(ctx).Errorf("Doing a proxy request to delegate %s : %s", hook, delegate.Service)
-	return proxy.DoRequest(ctx, *delegate, request)
+	ctx, cancel := proxy.WithCallerTimeout(ctx, req)
+	defer cancel()
+	response = proxy.DoRequest(ctx, delegate, forward)
+	if proxy.WantsPatchedObject(req) {
+		return delegate.AddPatchedObject(ctx, request, response)
+	}
+	return response
 }
@@ -0,0 +1,39 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pipeline
+
+import (
+	"context"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/mutating"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/validating"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/logging"
+)
+
+const queueName = "ProxyAdmissionPipeline"
+
+// NewController returns a constructor for the controller of the /pipeline
+// endpoint. It uses the delegates of the shared mutating and validating
+// Reconcilers and reconciles nothing itself, so it relies on their
+// controllers to run as well.
+func NewController(m *mutating.Controllers, v *validating.Controllers) injection.ControllerConstructor {
+	return func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+		validating := v.Reconciler(ctx)
+		r := &Reconciler{
+			mutating:    m.Reconciler(ctx),
+			validating:  validating,
+			gate:        validating.Gate(),
+			equivalents: validating.Equivalents(),
+		}
+		return controller.NewContext(ctx, r, controller.ControllerOptions{
+			WorkQueueName: queueName,
+			Logger:        logging.FromContext(ctx).Named(queueName),
+		})
+	}
+}
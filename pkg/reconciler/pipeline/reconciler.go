@@ -0,0 +1,78 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/gate"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/mutating"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/validating"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"knative.dev/pkg/apis"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/webhook"
+)
+
+const pipelinePath = "/pipeline"
+
+// Reconciler implements the AdmissionController that runs requests through
+// all the mutating and then all the validating webhooks.
+type Reconciler struct {
+	webhook.StatelessAdmissionImpl
+	mutating    *mutating.Reconciler
+	validating  *validating.Reconciler
+	gate        *gate.Gate
+	equivalents *proxy.EquivalentResources
+}
+
+var _ controller.Reconciler = (*Reconciler)(nil)
+var _ webhook.AdmissionController = (*Reconciler)(nil)
+
+// Reconcile does nothing, since nothing is ever enqueued.
+func (r *Reconciler) Reconcile(context.Context, string) error {
+	return nil
+}
+
+func (r *Reconciler) Path() string {
+	return pipelinePath
+}
+
+// Admit implements webhook.AdmissionController
+func (r *Reconciler) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	ns, response := r.gate.Admit(ctx, request)
+	if response != nil {
+		return response
+	}
+	req := apis.GetHTTPRequest(ctx)
+	request = proxy.ForceDryRun(req, request)
+	allowed := func(d *proxy.Delegate) (bool, error) {
+		return filter.AllowsHook(ns, d.Configuration, d.Name)
+	}
+	mutators, err := proxy.KeepDelegates(r.mutating.Delegates().All(), allowed)
+	if err != nil {
+		return proxy.CreateFailResponse(request.UID, fmt.Sprintf("Failed to check the hooks allowed in namespace %s: %s", request.Namespace, err))
+	}
+	validators, err := proxy.KeepDelegates(r.validating.Delegates().All(), allowed)
+	if err != nil {
+		return proxy.CreateFailResponse(request.UID, fmt.Sprintf("Failed to check the hooks allowed in namespace %s: %s", request.Namespace, err))
+	}
+	p := &proxy.Pipeline{
+		Mutating:    mutators,
+		Validating:  validators,
+		Equivalents: r.equivalents,
+	}
+	logging.FromContext(ctx).Debugf("Running request through %d mutating and %d validating delegates", len(p.Mutating), len(p.Validating))
+	ctx, cancel := proxy.WithCallerTimeout(ctx, req)
+	defer cancel()
+	return p.Admit(ctx, request, ns)
+}
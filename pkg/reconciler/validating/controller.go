@@ -7,33 +7,76 @@ package validating
 
 import (
 	"context"
+	"sync"
 
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
 	vwhinformer "knative.dev/pkg/client/injection/kube/informers/admissionregistration/v1/validatingwebhookconfiguration"
 	nsinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/namespace"
 
 	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
 	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/gate"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/logging"
 )
 
-const queueName = "ProxyAdmissionWebhook"
+const (
+	queueName       = "ProxyAdmissionWebhook"
+	fanOutQueueName = "ProxyAdmissionFanOut"
+)
 
-func NewController(ctx context.Context, _ configmap.Watcher) *controller.Impl {
-	vwhInformer := vwhinformer.Get(ctx)
-	nsInformer := nsinformer.Get(ctx)
-	r := &Reconciler{
-		delegates:    make(map[string]*proxy.Delegate),
-		vwhlister:    vwhInformer.Lister(),
-		nslister:     nsInformer.Lister(),
-		requireLabel: filter.GetRequireLabel(ctx),
-	}
+// Controllers creates the controllers that share one Reconciler, so that
+// the delegates, and their transports and circuit breakers, are only kept
+// once.
+type Controllers struct {
+	once       sync.Once
+	reconciler *Reconciler
+}
 
-	impl := controller.NewContext(ctx, r, controller.ControllerOptions{
+// Reconciler returns the shared Reconciler, creating it the first time.
+func (c *Controllers) Reconciler(ctx context.Context) *Reconciler {
+	c.once.Do(func() {
+		c.reconciler = NewReconciler(ctx)
+	})
+	return c.reconciler
+}
+
+// NewController returns the controller for the /admit endpoint, which also
+// keeps the delegates of the shared Reconciler up to date.
+func (c *Controllers) NewController(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+	impl := controller.NewContext(ctx, c.Reconciler(ctx), controller.ControllerOptions{
 		WorkQueueName: queueName,
 		Logger:        logging.FromContext(ctx).Named(queueName),
 	})
-	_, _ = vwhInformer.Informer().AddEventHandler(controller.HandleAll(impl.Enqueue))
+	_, _ = vwhinformer.Get(ctx).Informer().AddEventHandler(controller.HandleAll(impl.Enqueue))
 	return impl
 }
+
+// NewFanOutController returns the controller for the /admit-all endpoint.
+// It uses the delegates of the shared Reconciler and reconciles nothing
+// itself, so it relies on the controller of NewController to run as well.
+func (c *Controllers) NewFanOutController(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+	return controller.NewContext(ctx, &FanOut{Reconciler: c.Reconciler(ctx)}, controller.ControllerOptions{
+		WorkQueueName: fanOutQueueName,
+		Logger:        logging.FromContext(ctx).Named(fanOutQueueName),
+	})
+}
+
+func NewController(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+	return (&Controllers{}).NewController(ctx, cmw)
+}
+
+// NewReconciler returns a Reconciler with its own set of delegates, for
+// controllers that need to keep track of the
+// ValidatingWebhookConfigurations themselves.
+func NewReconciler(ctx context.Context) *Reconciler {
+	return &Reconciler{
+		delegates:   proxy.NewDelegates(),
+		vwhlister:   vwhinformer.Get(ctx).Lister(),
+		gate:        gate.New(filter.NewNamespaces(nsinformer.Get(ctx).Lister(), kubeclient.Get(ctx).CoreV1(), filter.GetNamespaceLookupOptions(ctx)), filter.GetChain(ctx)),
+		retry:       proxy.GetRetryOptions(ctx),
+		limits:      proxy.GetBodyLimits(ctx),
+		equivalents: proxy.NewEquivalentResources(kubeclient.Get(ctx).Discovery()),
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package validating
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	"knative.dev/pkg/apis"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/webhook"
+)
+
+const admitAllPath = "/admit-all"
+
+// FanOut calls all the validating webhooks that match a request at the same
+// time, and combines their responses into one.
+type FanOut struct {
+	*Reconciler
+}
+
+var _ webhook.AdmissionController = (*FanOut)(nil)
+
+func (f *FanOut) Path() string {
+	return admitAllPath
+}
+
+// Admit implements webhook.AdmissionController
+func (f *FanOut) Admit(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	ns, response := f.gate.Admit(ctx, request)
+	if response != nil {
+		return response
+	}
+	req := apis.GetHTTPRequest(ctx)
+	request = proxy.ForceDryRun(req, request)
+	delegates, err := proxy.SelectDelegates(req, f.delegates.All())
+	if err != nil {
+		return proxy.CreateFailResponse(request.UID, err.Error())
+	}
+	delegates, err = proxy.KeepDelegates(delegates, func(d *proxy.Delegate) (bool, error) {
+		return filter.AllowsHook(ns, d.Configuration, d.Name)
+	})
+	if err != nil {
+		return proxy.CreateFailResponse(request.UID, fmt.Sprintf("Failed to check the hooks allowed in namespace %s: %s", request.Namespace, err))
+	}
+
+	calls, failed := proxy.Calls(ctx, request, ns, delegates, f.equivalents)
+	logging.FromContext(ctx).Debugf("Fanning out request to %d delegates", len(calls))
+	ctx, cancel := proxy.WithCallerTimeout(ctx, req)
+	defer cancel()
+	return proxy.Aggregate(request.UID, append(failed, proxy.FanOut(ctx, calls)...))
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package validating
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/filter"
+	"github.com/chainguard-dev/admission-sidecar/pkg/reconciler/gate"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	nslisters "k8s.io/client-go/listers/core/v1"
+	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// TestAdmitExemptWithoutNamespace checks that exempt requests are let through
+// without looking up their namespace, so that they are not failed when the
+// lookup fails and the namespace failure policy is Fail.
+func TestAdmitExemptWithoutNamespace(t *testing.T) {
+	client := fakekube.NewSimpleClientset()
+	client.PrependReactor("get", "namespaces", func(clientgotesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("API server unavailable")
+	})
+	ctx := filter.WithUserRules(context.Background(), []filter.UserRule{{Usernames: []string{"system:kube-scheduler"}}})
+	filters, err := filter.NewChain(ctx, filter.DefaultFilters, nil)
+	if err != nil {
+		t.Fatalf("Failed to create chain: %s", err)
+	}
+	namespaces := filter.NewNamespaces(
+		nslisters.NewNamespaceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		client.CoreV1(),
+		filter.NamespaceLookupOptions{FailurePolicy: admissionregistrationv1.Fail},
+	)
+	r := &Reconciler{gate: gate.New(namespaces, filters)}
+
+	pod := metav1.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	tests := []struct {
+		name        string
+		request     *admissionv1.AdmissionRequest
+		wantAllowed bool
+		wantLookup  bool
+	}{{
+		name:        "exempt namespace",
+		request:     &admissionv1.AdmissionRequest{UID: "1", Namespace: "kube-system", Kind: pod},
+		wantAllowed: true,
+	}, {
+		name:        "exempt user",
+		request:     &admissionv1.AdmissionRequest{UID: "2", Namespace: "default", Kind: pod, UserInfo: authenticationv1.UserInfo{Username: "system:kube-scheduler"}},
+		wantAllowed: true,
+	}, {
+		name:       "not exempt",
+		request:    &admissionv1.AdmissionRequest{UID: "3", Namespace: "default", Kind: pod},
+		wantLookup: true,
+	}}
+	for _, tc := range tests {
+		client.ClearActions()
+		response := r.Admit(ctx, tc.request)
+		if response.Allowed != tc.wantAllowed {
+			t.Errorf("%q want allowed %t got %+v", tc.name, tc.wantAllowed, response)
+		}
+		if lookedUp := len(client.Actions()) > 0; lookedUp != tc.wantLookup {
+			t.Errorf("%q want namespace looked up %t got %v", tc.name, tc.wantLookup, client.Actions())
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package webhooks keeps the delegates of the webhook configurations up to
+// date, the same way for mutating and validating webhooks.
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+
+	v1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+)
+
+// Webhook has what MutatingWebhooks and ValidatingWebhooks have in common,
+// along with what only MutatingWebhooks have.
+type Webhook struct {
+	Name                    string
+	ClientConfig            v1.WebhookClientConfig
+	Rules                   []v1.RuleWithOperations
+	FailurePolicy           *v1.FailurePolicyType
+	MatchPolicy             *v1.MatchPolicyType
+	NamespaceSelector       *metav1.LabelSelector
+	ObjectSelector          *metav1.LabelSelector
+	SideEffects             *v1.SideEffectClass
+	TimeoutSeconds          *int32
+	AdmissionReviewVersions []string
+	MatchConditions         []v1.MatchCondition
+
+	// Mutating is set for MutatingWebhooks.
+	Mutating           bool
+	ReinvocationPolicy *v1.ReinvocationPolicyType
+}
+
+// FromMutating returns the Webhooks of a MutatingWebhookConfiguration.
+func FromMutating(in []v1.MutatingWebhook) []Webhook {
+	ret := make([]Webhook, 0, len(in))
+	for _, wh := range in {
+		ret = append(ret, Webhook{
+			Name:                    wh.Name,
+			ClientConfig:            wh.ClientConfig,
+			Rules:                   wh.Rules,
+			FailurePolicy:           wh.FailurePolicy,
+			MatchPolicy:             wh.MatchPolicy,
+			NamespaceSelector:       wh.NamespaceSelector,
+			ObjectSelector:          wh.ObjectSelector,
+			SideEffects:             wh.SideEffects,
+			TimeoutSeconds:          wh.TimeoutSeconds,
+			AdmissionReviewVersions: wh.AdmissionReviewVersions,
+			MatchConditions:         wh.MatchConditions,
+			Mutating:                true,
+			ReinvocationPolicy:      wh.ReinvocationPolicy,
+		})
+	}
+	return ret
+}
+
+// FromValidating returns the Webhooks of a ValidatingWebhookConfiguration.
+func FromValidating(in []v1.ValidatingWebhook) []Webhook {
+	ret := make([]Webhook, 0, len(in))
+	for _, wh := range in {
+		ret = append(ret, Webhook{
+			Name:                    wh.Name,
+			ClientConfig:            wh.ClientConfig,
+			Rules:                   wh.Rules,
+			FailurePolicy:           wh.FailurePolicy,
+			MatchPolicy:             wh.MatchPolicy,
+			NamespaceSelector:       wh.NamespaceSelector,
+			ObjectSelector:          wh.ObjectSelector,
+			SideEffects:             wh.SideEffects,
+			TimeoutSeconds:          wh.TimeoutSeconds,
+			AdmissionReviewVersions: wh.AdmissionReviewVersions,
+			MatchConditions:         wh.MatchConditions,
+		})
+	}
+	return ret
+}
+
+// Sync adds or updates the delegates for the webhooks of the configuration,
+// and removes the ones for webhooks that are no longer in it, or all of them
+// if the configuration is gone and there are no webhooks. Errors are reported
+// per webhook so that one bad webhook does not keep the others in the
+// configuration from being updated.
+func Sync(ctx context.Context, delegates *proxy.Delegates, config string, webhooks []Webhook, retry proxy.RetryOptions, limits proxy.BodyLimits) error {
+	var errs []error
+	names := make([]string, 0, len(webhooks))
+	for i, wh := range webhooks {
+		if err := addDelegate(ctx, delegates, config, i, wh, retry, limits); err != nil {
+			logging.FromContext(ctx).Errorf("Failed to add delegate %s: %s", wh.Name, err)
+			errs = append(errs, fmt.Errorf("webhook %s: %w", wh.Name, err))
+		}
+		names = append(names, wh.Name)
+	}
+	// And drop the ones that are gone.
+	if removed := delegates.Prune(config, names...); len(removed) > 0 {
+		logging.FromContext(ctx).Infof("Removed %s => %v", config, removed)
+	}
+	return reconcileError(errs)
+}
+
+// reconcileError joins the errors adding the webhooks. Unless all of them are
+// permanent, only the ones worth retrying are returned.
+func reconcileError(errs []error) error {
+	var retry []error
+	for _, err := range errs {
+		if !controller.IsPermanentError(err) {
+			retry = append(retry, err)
+		}
+	}
+	if len(retry) > 0 {
+		return errors.Join(retry...)
+	}
+	if len(errs) > 0 {
+		return controller.NewPermanentError(errors.Join(errs...))
+	}
+	return nil
+}
+
+func addDelegate(ctx context.Context, delegates *proxy.Delegates, config string, index int, wh Webhook, retry proxy.RetryOptions, limits proxy.BodyLimits) error {
+	name, clientConfig := wh.Name, wh.ClientConfig
+	delegate, err := proxy.WebhookClientConfigToURLAndCert(clientConfig)
+	if err != nil {
+		return err
+	}
+	delegate.Name = name
+	delegate.Configuration = config
+	delegate.Index = index
+	if delegate.ReviewVersion, err = proxy.NegotiateReviewVersion(wh.AdmissionReviewVersions); err != nil {
+		return err
+	}
+	delegate.Mutating = wh.Mutating
+	if wh.ReinvocationPolicy != nil {
+		delegate.ReinvocationPolicy = *wh.ReinvocationPolicy
+	}
+	delegate.Timeout = proxy.WebhookTimeout(wh.TimeoutSeconds)
+	delegate.Rules = wh.Rules
+	if wh.MatchPolicy != nil {
+		delegate.MatchPolicy = *wh.MatchPolicy
+	}
+	if err := delegate.SetSelectors(wh.NamespaceSelector, wh.ObjectSelector); err != nil {
+		return err
+	}
+	var conditionsErr error
+	if err := delegate.SetMatchConditions(wh.MatchConditions); err != nil {
+		// Retrying will not fix the expressions, so add the delegate anyway
+		// and have its requests fail according to its FailurePolicy until
+		// the webhook is fixed.
+		conditionsErr = controller.NewPermanentError(err)
+	}
+	if wh.SideEffects != nil {
+		delegate.SideEffects = *wh.SideEffects
+	}
+	delegate.Retry = retry
+	delegate.Limits = limits
+	if wh.FailurePolicy != nil {
+		delegate.FailurePolicy = *wh.FailurePolicy
+	}
+	delegates.Add(delegate)
+	if clientConfig.Service != nil {
+		logging.FromContext(ctx).Infof("Added %s/%s => Service: %+v", config, name, clientConfig.Service)
+	} else {
+		logging.FromContext(ctx).Infof("Added %s/%s => URL: %s", config, name, *clientConfig.URL)
+	}
+	return conditionsErr
+}
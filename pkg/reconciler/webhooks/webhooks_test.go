@@ -0,0 +1,74 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+
+	v1 "k8s.io/api/admissionregistration/v1"
+
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/ptr"
+)
+
+func TestSync(t *testing.T) {
+	url := "https://delegate.example.com"
+	ifNeeded := v1.IfNeededReinvocationPolicy
+	ignore := v1.Ignore
+	ds := proxy.NewDelegates()
+	ctx := context.Background()
+
+	err := Sync(ctx, ds, "config", FromMutating([]v1.MutatingWebhook{{
+		Name:               "good.webhook",
+		ClientConfig:       v1.WebhookClientConfig{URL: &url},
+		ReinvocationPolicy: &ifNeeded,
+		FailurePolicy:      &ignore,
+		TimeoutSeconds:     ptr.Int32(3),
+	}, {
+		Name:            "bad.webhook",
+		ClientConfig:    v1.WebhookClientConfig{URL: &url},
+		MatchConditions: []v1.MatchCondition{{Name: "broken", Expression: "request.kind =="}},
+	}}), proxy.RetryOptions{Attempts: 2}, proxy.BodyLimits{})
+	if !controller.IsPermanentError(err) {
+		t.Errorf("Wanted a permanent error for the bad matchConditions, got %v", err)
+	}
+	all := ds.All()
+	if len(all) != 2 {
+		t.Fatalf("Wanted both delegates added, got %v", all)
+	}
+	good, err := ds.Lookup("config/good.webhook")
+	if err != nil {
+		t.Fatalf("Failed to look up delegate: %s", err)
+	}
+	if !good.Mutating || good.ReinvocationPolicy != ifNeeded || good.FailurePolicy != ignore || good.Index != 0 || good.Retry.Attempts != 2 {
+		t.Errorf("Delegate not set up from the webhook: %+v", good)
+	}
+	if good.Timeout != proxy.WebhookTimeout(ptr.Int32(3)) {
+		t.Errorf("Wanted timeout of 3s, got %s", good.Timeout)
+	}
+
+	// Validating webhooks replace the delegates of the configuration.
+	if err := Sync(ctx, ds, "config", FromValidating([]v1.ValidatingWebhook{{
+		Name:         "good.webhook",
+		ClientConfig: v1.WebhookClientConfig{URL: &url},
+	}}), proxy.RetryOptions{}, proxy.BodyLimits{}); err != nil {
+		t.Fatalf("Failed to sync: %s", err)
+	}
+	if all := ds.All(); len(all) != 1 || all[0].Mutating {
+		t.Errorf("Wanted only the validating delegate, got %v", all)
+	}
+
+	// Without webhooks, the configuration is gone.
+	if err := Sync(ctx, ds, "config", nil, proxy.RetryOptions{}, proxy.BodyLimits{}); err != nil {
+		t.Fatalf("Failed to sync: %s", err)
+	}
+	if all := ds.All(); len(all) != 0 {
+		t.Errorf("Wanted all delegates removed, got %v", all)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 Chainguard, Inc.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package server serves the admission controllers of the sidecar, the way
+// sharedmain does for webhooks, except that the request bodies are limited
+// before the knative webhook reads and decodes them, and that the admission
+// controllers can set headers of the HTTP response.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chainguard-dev/admission-sidecar/pkg/proxy"
+	"go.uber.org/zap"
+
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/network/handlers"
+	"knative.dev/pkg/webhook"
+)
+
+const queueName = "ProxyAdmissionServer"
+
+// Server collects the admission controllers of the controllers registered
+// with it, and serves them once its own controller is created.
+type Server struct {
+	controllers []interface{}
+}
+
+var _ controller.Reconciler = (*Server)(nil)
+
+// Register returns a constructor for the controller that hides its admission
+// controller from sharedmain, so that the Server serves it instead. Only
+// stateless admission controllers are supported, since the Server does not
+// know when the informers have synced.
+func (s *Server) Register(ctor injection.ControllerConstructor) injection.ControllerConstructor {
+	return func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+		impl := ctor(ctx, cmw)
+		ac, ok := impl.Reconciler.(webhook.AdmissionController)
+		if !ok {
+			return impl
+		}
+		if _, ok := ac.(webhook.StatelessAdmissionController); !ok {
+			logging.FromContext(ctx).Fatalf("Admission controller for %s is not stateless", ac.Path())
+		}
+		s.controllers = append(s.controllers, ac)
+		impl.Reconciler = hidden{Reconciler: impl.Reconciler}
+		return impl
+	}
+}
+
+// hidden only exposes the controller.Reconciler of the reconciler.
+type hidden struct {
+	controller.Reconciler
+}
+
+// NewController starts serving the admission controllers registered so far,
+// so it has to come after them in the constructors given to sharedmain. The
+// controller itself has nothing to do.
+func (s *Server) NewController(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+	logger := logging.FromContext(ctx)
+	webhook.RegisterMetrics()
+	wh, err := webhook.New(ctx, s.controllers)
+	if err != nil {
+		logger.Fatalw("Failed to create webhook", zap.Error(err))
+	}
+	limits := proxy.GetBodyLimits(ctx)
+	go func() {
+		handler := proxy.LimitRequestBody(proxy.WithResponseHeaders(wh), limits.MaxRequestBytes)
+		if err := serve(ctx, handler); err != nil {
+			logger.Fatalw("Failed to serve webhook", zap.Error(err))
+		}
+	}()
+	return controller.NewContext(ctx, s, controller.ControllerOptions{
+		WorkQueueName: queueName,
+		Logger:        logger.Named(queueName),
+	})
+}
+
+// Reconcile does nothing, since nothing is ever enqueued.
+func (s *Server) Reconcile(context.Context, string) error {
+	return nil
+}
+
+// serve serves the handler on the port of the webhook Options until ctx is
+// done, draining connections on the way out like the knative webhook does.
+func serve(ctx context.Context, handler http.Handler) error {
+	opts := webhook.GetOptions(ctx)
+	if opts == nil {
+		return errors.New("context must have webhook Options specified")
+	}
+	if opts.SecretName != "" {
+		return errors.New("serving TLS from a secret is not supported")
+	}
+	drainer := &handlers.Drainer{
+		Inner:       handler,
+		QuietPeriod: opts.GracePeriod,
+	}
+	server := &http.Server{
+		Handler:           drainer,
+		Addr:              fmt.Sprint(":", opts.Port),
+		ReadHeaderTimeout: time.Minute,
+	}
+	go func() {
+		<-ctx.Done()
+		server.SetKeepAlivesEnabled(false)
+		drainer.Drain()
+		_ = server.Shutdown(context.Background())
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}